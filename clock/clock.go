@@ -0,0 +1,133 @@
+// Package clock implements the clock interfaces of k8s.io/utils/clock on
+// the time of the simulation, as told by github.com/oar-team/batsky-go/time.
+//
+// Components which take an injectable clock, such as client-go's work
+// queues or the scheduler framework, can be given a Clock to follow the
+// simulation without rewriting their use of the time package:
+//
+//	queue := workqueue.NewDelayingQueueWithCustomClock(clock.Clock{}, "pods")
+package clock
+
+import (
+	"time"
+
+	btime "github.com/oar-team/batsky-go/time"
+	"k8s.io/utils/clock"
+)
+
+var (
+	_ clock.WithTickerAndDelayedExecution = Clock{}
+	_ clock.Timer                         = (*timer)(nil)
+	_ clock.Ticker                        = (*ticker)(nil)
+)
+
+// source is what a Clock takes the time from : a *btime.Requester, or the
+// package level functions.
+type source interface {
+	Now() time.Time
+	NewTimer(d time.Duration) *btime.Timer
+	AfterFunc(d time.Duration, f func()) *btime.Timer
+	NewTicker(d time.Duration) *btime.Ticker
+	Sleep(d time.Duration)
+}
+
+// defaultSource goes through the default requester of the time package.
+type defaultSource struct{}
+
+func (defaultSource) Now() time.Time                        { return btime.Now() }
+func (defaultSource) NewTimer(d time.Duration) *btime.Timer { return btime.NewTimer(d) }
+func (defaultSource) NewTicker(d time.Duration) *btime.Ticker {
+	return btime.NewTicker(d)
+}
+func (defaultSource) Sleep(d time.Duration) { btime.Sleep(d) }
+func (defaultSource) AfterFunc(d time.Duration, f func()) *btime.Timer {
+	return btime.AfterFunc(d, f)
+}
+
+// Clock implements clock.WithTickerAndDelayedExecution in simulated time.
+// The zero Clock uses the default requester of the time package.
+type Clock struct {
+	s source
+}
+
+// New returns a Clock using the requester r, or the default requester if
+// r is nil.
+func New(r *btime.Requester) Clock {
+	if r == nil {
+		return Clock{}
+	}
+	return Clock{s: r}
+}
+
+func (c Clock) source() source {
+	if c.s == nil {
+		return defaultSource{}
+	}
+	return c.s
+}
+
+// Now returns the current simulated time.
+func (c Clock) Now() time.Time {
+	return c.source().Now()
+}
+
+// Since returns the simulated time elapsed since t.
+func (c Clock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// After waits for the duration to elapse and then sends the current time
+// on the returned channel.
+func (c Clock) After(d time.Duration) <-chan time.Time {
+	return c.source().NewTimer(d).C
+}
+
+// NewTimer returns a Timer sending the current time on its channel after
+// at least duration d.
+func (c Clock) NewTimer(d time.Duration) clock.Timer {
+	return &timer{c.source().NewTimer(d)}
+}
+
+// AfterFunc waits for the duration to elapse and then calls f in its own
+// goroutine. It returns a Timer that can be used to cancel the call using
+// its Stop method. The channel of the Timer is nil.
+func (c Clock) AfterFunc(d time.Duration, f func()) clock.Timer {
+	return &timer{c.source().AfterFunc(d, f)}
+}
+
+// Sleep pauses the current goroutine for at least the duration d.
+func (c Clock) Sleep(d time.Duration) {
+	c.source().Sleep(d)
+}
+
+// Tick returns the channel of a new Ticker. The Ticker is never stopped,
+// like with time.Tick. It returns nil if d <= 0.
+func (c Clock) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return c.source().NewTicker(d).C
+}
+
+// NewTicker returns a Ticker sending the current time on its channel with
+// a period of d. It panics if d <= 0.
+func (c Clock) NewTicker(d time.Duration) clock.Ticker {
+	return &ticker{c.source().NewTicker(d)}
+}
+
+// timer is a clock.Timer backed by a *btime.Timer.
+type timer struct {
+	t *btime.Timer
+}
+
+func (t *timer) C() <-chan time.Time        { return t.t.C }
+func (t *timer) Stop() bool                 { return t.t.Stop() }
+func (t *timer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+// ticker is a clock.Ticker backed by a *btime.Ticker.
+type ticker struct {
+	t *btime.Ticker
+}
+
+func (t *ticker) C() <-chan time.Time { return t.t.C }
+func (t *ticker) Stop()               { t.t.Stop() }
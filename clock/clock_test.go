@@ -0,0 +1,108 @@
+package clock
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	btime "github.com/oar-team/batsky-go/time"
+)
+
+func TestMain(m *testing.M) {
+	c := btime.DefaultConfig()
+	c.Mode = btime.ModeVirtual
+	if err := btime.Configure(c); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestNowSince(t *testing.T) {
+	var c Clock
+	start := c.Now()
+	btime.Advance(time.Minute)
+	if d := c.Since(start); d != time.Minute {
+		t.Errorf("got %v since the start, want %v", d, time.Minute)
+	}
+}
+
+func TestTimer(t *testing.T) {
+	var c Clock
+	start := c.Now()
+	timer := c.NewTimer(time.Second)
+	btime.Advance(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("fired before its time")
+	default:
+	}
+	btime.Advance(time.Millisecond)
+	if got := <-timer.C(); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("fired at %v, want %v", got, start.Add(time.Second))
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("Reset of an expired timer returned true")
+	}
+	if !timer.Stop() {
+		t.Error("Stop of a waiting timer returned false")
+	}
+	btime.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Error("fired after Stop")
+	default:
+	}
+}
+
+func TestAfterFunc(t *testing.T) {
+	var c Clock
+	fired := make(chan struct{})
+	c.AfterFunc(time.Second, func() { close(fired) })
+	stopped := c.AfterFunc(time.Second, func() { t.Error("stopped function called") })
+	if stopped.C() != nil {
+		t.Error("AfterFunc timer has a channel")
+	}
+	stopped.Stop()
+	btime.Advance(time.Second)
+	<-fired
+}
+
+func TestTicker(t *testing.T) {
+	var c Clock
+	start := c.Now()
+	ticker := c.NewTicker(time.Second)
+	defer ticker.Stop()
+	for i := 1; i <= 3; i++ {
+		btime.Advance(time.Second)
+		want := start.Add(time.Duration(i) * time.Second)
+		if got := <-ticker.C(); !got.Equal(want) {
+			t.Errorf("tick %d at %v, want %v", i, got, want)
+		}
+	}
+	if c.Tick(0) != nil {
+		t.Error("Tick(0) returned a channel")
+	}
+}
+
+func TestRequester(t *testing.T) {
+	conf := btime.DefaultConfig()
+	conf.Mode, conf.AutoAdvance = btime.ModeVirtual, true
+	r, err := btime.NewRequester(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Shutdown(context.Background())
+
+	c := New(r)
+	start, other := c.Now(), btime.Now()
+	c.Sleep(time.Hour)
+	<-c.After(time.Hour)
+	if d := c.Since(start); d != 2*time.Hour {
+		t.Errorf("got %v since the start, want %v", d, 2*time.Hour)
+	}
+	if !btime.Now().Equal(other) {
+		t.Error("the default requester moved")
+	}
+}
@@ -0,0 +1,158 @@
+// Package context is a replacement for the standard context package, whose
+// deadlines follow the time of the simulation instead of the wall clock.
+//
+// WithDeadline and WithTimeout wait for the time given by the broker, as
+// told by github.com/oar-team/batsky-go/time. Everything else is the
+// standard package : its contexts and the ones of this package can be
+// mixed freely, in both directions.
+package context
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	btime "github.com/oar-team/batsky-go/time"
+)
+
+// The types, values and functions of the standard package, which do not
+// depend on time.
+type (
+	Context    = context.Context
+	CancelFunc = context.CancelFunc
+)
+
+var (
+	Canceled         = context.Canceled
+	DeadlineExceeded = context.DeadlineExceeded
+)
+
+func Background() Context { return context.Background() }
+func TODO() Context       { return context.TODO() }
+
+func WithCancel(parent Context) (Context, CancelFunc) {
+	return context.WithCancel(parent)
+}
+
+func WithValue(parent Context, key, val interface{}) Context {
+	return context.WithValue(parent, key, val)
+}
+
+// WithDeadline returns a copy of the parent context with the deadline
+// adjusted to be no later than d, in simulated time. If the parent's
+// deadline is already earlier than d, WithDeadline(parent, d) is
+// semantically equivalent to parent. The returned context's Done channel
+// is closed when the deadline expires, when the returned cancel function
+// is called, or when the parent context's Done channel is closed,
+// whichever happens first.
+//
+// Canceling this context releases resources associated with it, so code
+// should call cancel as soon as the operations running in this Context
+// complete.
+func WithDeadline(parent Context, d time.Time) (Context, CancelFunc) {
+	if parent == nil {
+		panic("cannot create context from nil parent")
+	}
+	if cur, ok := parent.Deadline(); ok && cur.Before(d) {
+		// The current deadline is already sooner than the new one.
+		return context.WithCancel(parent)
+	}
+	c := &timerCtx{
+		Context:  parent,
+		deadline: d,
+		done:     make(chan struct{}),
+	}
+	// Parents of any kind are watched through their Done channel, the
+	// way the standard package does for contexts it does not know.
+	if done := parent.Done(); done != nil {
+		select {
+		case <-done:
+			c.cancel(parent.Err())
+			return c, func() { c.cancel(Canceled) }
+		default:
+		}
+		go func() {
+			select {
+			case <-done:
+				c.cancel(parent.Err())
+			case <-c.done:
+			}
+		}()
+	}
+
+	dur := d.Sub(btime.Now())
+	if dur <= 0 {
+		c.cancel(DeadlineExceeded) // deadline has already passed
+		return c, func() { c.cancel(Canceled) }
+	}
+	// Starting the timer asks the broker for the time, which is not done
+	// under the lock.
+	t := btime.AfterFunc(dur, func() {
+		c.cancel(DeadlineExceeded)
+	})
+	c.mu.Lock()
+	if c.err == nil {
+		c.timer = t
+	} else {
+		t.Stop()
+	}
+	c.mu.Unlock()
+	return c, func() { c.cancel(Canceled) }
+}
+
+// WithTimeout returns WithDeadline(parent, btime.Now().Add(timeout)).
+//
+// Canceling this context releases resources associated with it, so code
+// should call cancel as soon as the operations running in this Context
+// complete:
+//
+// 	func slowOperationWithTimeout(ctx context.Context) (Result, error) {
+// 		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+// 		defer cancel()  // releases resources if slowOperation completes before timeout elapses
+// 		return slowOperation(ctx)
+// 	}
+func WithTimeout(parent Context, timeout time.Duration) (Context, CancelFunc) {
+	return WithDeadline(parent, btime.Now().Add(timeout))
+}
+
+// A timerCtx is done when its deadline expires in simulated time, when it
+// is canceled, or when its parent is done. Values come from the parent.
+type timerCtx struct {
+	context.Context // parent
+
+	deadline time.Time
+	done     chan struct{}
+
+	mu    sync.Mutex
+	timer *btime.Timer // nil once done
+	err   error        // set when done is closed
+}
+
+func (c *timerCtx) Deadline() (time.Time, bool) { return c.deadline, true }
+
+func (c *timerCtx) Done() <-chan struct{} { return c.done }
+
+func (c *timerCtx) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *timerCtx) String() string {
+	return "context.WithDeadline(" + c.deadline.String() + " [simulated])"
+}
+
+// cancel closes c.done and stops the timer, unless c is done already.
+func (c *timerCtx) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
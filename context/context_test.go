@@ -0,0 +1,125 @@
+package context
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	btime "github.com/oar-team/batsky-go/time"
+)
+
+func TestMain(m *testing.M) {
+	c := btime.DefaultConfig()
+	c.Mode = btime.ModeVirtual
+	if err := btime.Configure(c); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// done reports whether ctx is done.
+func done(ctx Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	start := btime.Now()
+	ctx, cancel := WithTimeout(Background(), time.Second)
+	defer cancel()
+
+	if d, ok := ctx.Deadline(); !ok || !d.Equal(start.Add(time.Second)) {
+		t.Errorf("got deadline %v, %v, want %v", d, ok, start.Add(time.Second))
+	}
+	btime.Advance(999 * time.Millisecond)
+	if done(ctx) {
+		t.Fatal("done before the deadline")
+	}
+	btime.Advance(time.Millisecond)
+	<-ctx.Done()
+	if err := ctx.Err(); err != DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, DeadlineExceeded)
+	}
+}
+
+func TestWithDeadlineCancel(t *testing.T) {
+	ctx, cancel := WithDeadline(Background(), btime.Now().Add(time.Second))
+	cancel()
+	<-ctx.Done()
+	if err := ctx.Err(); err != Canceled {
+		t.Errorf("got error %v, want %v", err, Canceled)
+	}
+	// The timer is stopped.
+	btime.Advance(time.Second)
+	if err := ctx.Err(); err != Canceled {
+		t.Errorf("got error %v after the deadline, want %v", err, Canceled)
+	}
+}
+
+func TestWithDeadlinePassed(t *testing.T) {
+	ctx, cancel := WithDeadline(Background(), btime.Now().Add(-time.Second))
+	defer cancel()
+	if !done(ctx) || ctx.Err() != DeadlineExceeded {
+		t.Errorf("got error %v, want %v at once", ctx.Err(), DeadlineExceeded)
+	}
+}
+
+type key struct{}
+
+func TestStdParent(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.WithValue(context.Background(), key{}, "v"))
+	ctx, cancel := WithTimeout(parent, time.Hour)
+	defer cancel()
+	if v := ctx.Value(key{}); v != "v" {
+		t.Errorf("got value %v, want v", v)
+	}
+	cancelParent()
+	<-ctx.Done()
+	if err := ctx.Err(); err != Canceled {
+		t.Errorf("got error %v, want %v", err, Canceled)
+	}
+}
+
+func TestStdChild(t *testing.T) {
+	ctx, cancel := WithTimeout(Background(), time.Second)
+	defer cancel()
+	child, cancelChild := context.WithCancel(ctx)
+	defer cancelChild()
+	if d, ok := child.Deadline(); !ok || d != mustDeadline(t, ctx) {
+		t.Errorf("child got deadline %v, %v", d, ok)
+	}
+	btime.Advance(time.Second)
+	<-child.Done()
+	if err := child.Err(); err != DeadlineExceeded {
+		t.Errorf("child got error %v, want %v", err, DeadlineExceeded)
+	}
+}
+
+func TestEarlierParentDeadline(t *testing.T) {
+	parent, cancelParent := WithTimeout(Background(), time.Second)
+	defer cancelParent()
+	ctx, cancel := WithTimeout(parent, time.Hour)
+	defer cancel()
+	if d, _ := ctx.Deadline(); d != mustDeadline(t, parent) {
+		t.Errorf("got deadline %v, want the one of the parent", d)
+	}
+	btime.Advance(time.Second)
+	<-ctx.Done()
+	if err := ctx.Err(); err != DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, DeadlineExceeded)
+	}
+}
+
+func mustDeadline(t *testing.T, ctx Context) time.Time {
+	t.Helper()
+	d, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("no deadline")
+	}
+	return d
+}
@@ -3,6 +3,6 @@ module github.com/oar-team/batsky-go
 go 1.14
 
 require (
-	github.com/google/uuid v1.1.1
 	github.com/pebbe/zmq4 v1.2.0
+	k8s.io/utils v0.0.0-20220210201930-3a6ce19ff2f9
 )
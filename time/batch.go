@@ -0,0 +1,179 @@
+package time
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// entryKind tells what a timer entry of a batch asks the broker.
+type entryKind uint8
+
+const (
+	// Register a timer, which translates into a CALL_ME_LATER.
+	entryTimer entryKind = iota
+
+	// Withdraw a timer registered in a previous exchange.
+	entryCancel
+)
+
+var entryKindNames = [...]string{
+	entryTimer:  "timer",
+	entryCancel: "cancel",
+}
+
+func (k entryKind) MarshalText() ([]byte, error) {
+	if int(k) >= len(entryKindNames) {
+		return nil, fmt.Errorf("unknown entry kind %d", k)
+	}
+	return []byte(entryKindNames[k]), nil
+}
+
+func (k *entryKind) UnmarshalText(b []byte) error {
+	for i, name := range entryKindNames {
+		if name == string(b) {
+			*k = entryKind(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown entry kind %q", b)
+}
+
+// timerEntry is one of the timer requests of a batch.
+type timerEntry struct {
+	ID       uint64    `json:"id"`
+	Kind     entryKind `json:"kind"`
+	Duration int64     `json:"duration,omitempty"`
+}
+
+// status is what the requester says about itself in a batch, with the
+// quiescence feature.
+type status struct {
+	// Idle tells that the requester has no work in flight : its
+	// goroutines are all waiting for timers.
+	Idle bool `json:"idle"`
+
+	// NextWakeup is when the next timer is due, in nanoseconds, -1 if
+	// there is none.
+	NextWakeup int64 `json:"next_wakeup"`
+}
+
+// quiescentBatch is a json batch with the quiescence feature.
+type quiescentBatch struct {
+	Timers interface{} `json:"timers"`
+	status
+}
+
+// encodeBatch encodes the timer requests sent to the broker in an exchange,
+// along with the status of the requester.
+//
+// By default a batch is a json array of durations, in nanoseconds. With the
+// timer-ids feature, it is a json array of timer entries instead.
+//
+// With the binary feature, a batch is the number of entries as a little
+// endian uint32, followed by each entry : its duration as a little endian
+// int64, preceded by its id as a little endian uint64 and its kind as a
+// byte with the timer-ids feature.
+//
+// Cancellations are only sent with the cancel feature.
+//
+// With the quiescence feature, the status follows : a json batch becomes
+// an object holding the timers array, idle and next_wakeup. A binary batch
+// is followed by a byte set to 1 if idle, and the next wakeup as a little
+// endian int64.
+func encodeBatch(timers []timerEntry, st status, s session) ([]byte, error) {
+	if !s.features.has(featureCancel) {
+		n := 0
+		for _, e := range timers {
+			if e.Kind != entryCancel {
+				timers[n] = e
+				n++
+			}
+		}
+		timers = timers[:n]
+	}
+	if timers == nil {
+		// Still an array, not null
+		timers = []timerEntry{}
+	}
+	ids := s.features.has(featureTimerIDs)
+	quiescence := s.features.has(featureQuiescence)
+
+	if !s.features.has(featureBinary) {
+		var v interface{} = timers
+		if !ids {
+			durations := make([]int64, len(timers))
+			for i, e := range timers {
+				durations[i] = e.Duration
+			}
+			v = durations
+		}
+		if quiescence {
+			v = quiescentBatch{Timers: v, status: st}
+		}
+		return json.Marshal(v)
+	}
+
+	size := 8
+	if ids {
+		size += 9
+	}
+	n := 4 + size*len(timers)
+	if quiescence {
+		n += 9
+	}
+	b := make([]byte, n)
+	binary.LittleEndian.PutUint32(b, uint32(len(timers)))
+	for i, e := range timers {
+		p := b[4+size*i:]
+		if ids {
+			binary.LittleEndian.PutUint64(p, e.ID)
+			p[8] = byte(e.Kind)
+			p = p[9:]
+		}
+		binary.LittleEndian.PutUint64(p, uint64(e.Duration))
+	}
+	if quiescence {
+		p := b[4+size*len(timers):]
+		if st.Idle {
+			p[0] = 1
+		}
+		binary.LittleEndian.PutUint64(p[1:], uint64(st.NextWakeup))
+	}
+	return b, nil
+}
+
+// decodeTime decodes the reply of the broker to a batch : the current
+// simulation time as a little endian int64, in nanoseconds. With the
+// timer-ids feature, it may be followed by the number of timers which fired
+// as a little endian uint32, and their ids as little endian uint64.
+func decodeTime(b []byte, s session) (int64, []uint64, error) {
+	if len(b) < 8 {
+		return 0, nil, fmt.Errorf("expected at least 8 bytes, got %d", len(b))
+	}
+	now := int64(binary.LittleEndian.Uint64(b))
+	// overflow
+	if now < 0 {
+		now = 1<<63 - 1 // math.MaxInt64
+	}
+	b = b[8:]
+	if len(b) == 0 {
+		return now, nil, nil
+	}
+	if !s.features.has(featureTimerIDs) {
+		return 0, nil, fmt.Errorf("unexpected %d bytes after the time", len(b))
+	}
+	if len(b) < 4 {
+		return 0, nil, fmt.Errorf("truncated fired timers count")
+	}
+	n := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	if uint64(len(b)) != 8*uint64(n) {
+		return 0, nil, fmt.Errorf("expected %d fired timers, got %d bytes", n, len(b))
+	}
+	fired := make([]uint64, n)
+	for i := range fired {
+		fired[i] = binary.LittleEndian.Uint64(b[8*i:])
+	}
+	return now, fired, nil
+}
@@ -0,0 +1,232 @@
+package time
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var (
+	binarySession = session{version: 2, features: featureBinary}
+	idsSession    = session{version: 2, features: featureTimerIDs | featureCancel}
+	fullSession   = session{version: 2, features: featureTimerIDs | featureCancel | featureBinary}
+)
+
+// decodeBatch does what the broker does with a batch.
+func decodeBatch(b []byte, s session) ([]timerEntry, error) {
+	timers, _, err := decodeBatchStatus(b, s)
+	return timers, err
+}
+
+// decodeBatchStatus is decodeBatch, also returning the status of the
+// requester with the quiescence feature.
+func decodeBatchStatus(b []byte, s session) ([]timerEntry, status, error) {
+	var timers []timerEntry
+	var st status
+	ids := s.features.has(featureTimerIDs)
+	quiescence := s.features.has(featureQuiescence)
+	if !s.features.has(featureBinary) {
+		if quiescence {
+			var q struct {
+				Timers json.RawMessage `json:"timers"`
+				status
+			}
+			if err := json.Unmarshal(b, &q); err != nil {
+				return nil, st, err
+			}
+			b, st = q.Timers, q.status
+		}
+		if ids {
+			err := json.Unmarshal(b, &timers)
+			return timers, st, err
+		}
+		var durations []int64
+		if err := json.Unmarshal(b, &durations); err != nil {
+			return nil, st, err
+		}
+		for _, d := range durations {
+			timers = append(timers, timerEntry{Duration: d})
+		}
+		return timers, st, nil
+	}
+	if len(b) < 4 {
+		return nil, st, errors.New("short batch")
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	size := 8
+	if ids {
+		size += 9
+	}
+	end := 4 + size*n
+	if quiescence {
+		if len(b) != end+9 {
+			return nil, st, errors.New("bad batch length")
+		}
+		st.Idle = b[end] == 1
+		st.NextWakeup = int64(binary.LittleEndian.Uint64(b[end+1:]))
+	} else if len(b) != end {
+		return nil, st, errors.New("bad batch length")
+	}
+	for i := 0; i < n; i++ {
+		var e timerEntry
+		p := b[4+size*i:]
+		if ids {
+			e.ID = binary.LittleEndian.Uint64(p)
+			e.Kind = entryKind(p[8])
+			p = p[9:]
+		}
+		e.Duration = int64(binary.LittleEndian.Uint64(p))
+		timers = append(timers, e)
+	}
+	return timers, st, nil
+}
+
+func TestEncodeBatch(t *testing.T) {
+	timers := []timerEntry{
+		{ID: 1, Kind: entryTimer, Duration: 1},
+		{ID: 2, Kind: entryCancel},
+		{ID: 3, Kind: entryTimer, Duration: 1<<63 - 1},
+	}
+	withoutIDs := []timerEntry{{Duration: 1}, {Duration: 1<<63 - 1}}
+	tests := []struct {
+		s    session
+		want []timerEntry
+	}{
+		{legacySession, withoutIDs},
+		{binarySession, withoutIDs},
+		{idsSession, timers},
+		{fullSession, timers},
+		// Cancellations are dropped if the broker can't handle them
+		{session{version: 2, features: featureTimerIDs}, []timerEntry{timers[0], timers[2]}},
+	}
+	for _, test := range tests {
+		b, err := encodeBatch(append([]timerEntry(nil), timers...), status{}, test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeBatch(b, test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("features %v: got %v, want %v", test.s.features, got, test.want)
+		}
+	}
+}
+
+func TestEncodeBatchWire(t *testing.T) {
+	timers := []timerEntry{{ID: 1, Kind: entryTimer, Duration: 2}, {ID: 3, Kind: entryCancel}}
+	tests := []struct {
+		s    session
+		want string
+	}{
+		{legacySession, `[2]`},
+		{idsSession, `[{"id":1,"kind":"timer","duration":2},{"id":3,"kind":"cancel"}]`},
+		{binarySession, "\x01\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00"},
+		{fullSession, "\x02\x00\x00\x00" +
+			"\x01\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00" +
+			"\x03\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00"},
+	}
+	for _, test := range tests {
+		b, err := encodeBatch(append([]timerEntry(nil), timers...), status{}, test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.want {
+			t.Errorf("features %v: got %q, want %q", test.s.features, b, test.want)
+		}
+	}
+
+	b, _ := encodeBatch(nil, status{}, binarySession)
+	if want := "\x00\x00\x00\x00"; string(b) != want {
+		t.Errorf("got empty batch %q, want %q", b, want)
+	}
+}
+
+func TestEncodeBatchStatus(t *testing.T) {
+	timers := []timerEntry{{ID: 1, Kind: entryTimer, Duration: 2}}
+	st := status{Idle: true, NextWakeup: 5}
+	tests := []struct {
+		s    session
+		want string
+	}{
+		{session{version: 2, features: featureQuiescence}, `{"timers":[2],"idle":true,"next_wakeup":5}`},
+		{session{version: 2, features: featureTimerIDs | featureQuiescence}, `{"timers":[{"id":1,"kind":"timer","duration":2}],"idle":true,"next_wakeup":5}`},
+		{session{version: 2, features: featureBinary | featureQuiescence}, "\x01\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00" +
+			"\x01\x05\x00\x00\x00\x00\x00\x00\x00"},
+	}
+	for _, test := range tests {
+		b, err := encodeBatch(append([]timerEntry(nil), timers...), st, test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.want {
+			t.Errorf("features %v: got %q, want %q", test.s.features, b, test.want)
+		}
+		if _, got, err := decodeBatchStatus(b, test.s); err != nil || got != st {
+			t.Errorf("features %v: decoded %+v, %v, want %+v", test.s.features, got, err, st)
+		}
+	}
+}
+
+func benchmarkEncodeBatch(b *testing.B, s session) {
+	timers := make([]timerEntry, 10000)
+	for i := range timers {
+		timers[i] = timerEntry{ID: uint64(i), Duration: int64(i) * 1e6}
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encodeBatch(timers, status{}, s)
+	}
+}
+
+func BenchmarkEncodeBatchJSON(b *testing.B) {
+	benchmarkEncodeBatch(b, legacySession)
+}
+
+func BenchmarkEncodeBatchBinary(b *testing.B) {
+	benchmarkEncodeBatch(b, binarySession)
+}
+
+func BenchmarkEncodeBatchJSONWithIDs(b *testing.B) {
+	benchmarkEncodeBatch(b, idsSession)
+}
+
+func BenchmarkEncodeBatchBinaryWithIDs(b *testing.B) {
+	benchmarkEncodeBatch(b, fullSession)
+}
+
+func TestDecodeTime(t *testing.T) {
+	tests := []struct {
+		msg   []byte
+		s     session
+		now   int64
+		fired []uint64
+	}{
+		{encodeNow(42), legacySession, 42, nil},
+		{encodeNow(42), idsSession, 42, nil},
+		{encodeNow(42, 1, 3), idsSession, 42, []uint64{1, 3}},
+		{encodeNow(-1), legacySession, 1<<63 - 1, nil},
+	}
+	for _, test := range tests {
+		now, fired, err := decodeTime(test.msg, test.s)
+		if err != nil {
+			t.Errorf("%q: %v", test.msg, err)
+			continue
+		}
+		if now != test.now || !reflect.DeepEqual(fired, test.fired) {
+			t.Errorf("%q: got %d %v, want %d %v", test.msg, now, fired, test.now, test.fired)
+		}
+	}
+
+	for _, msg := range [][]byte{{}, encodeNow(42)[:7], append(encodeNow(42, 1), 0), encodeNow(42, 1)[:11]} {
+		if _, _, err := decodeTime(msg, idsSession); err == nil {
+			t.Errorf("%q: expected an error", msg)
+		}
+	}
+	if _, _, err := decodeTime(encodeNow(42, 1), legacySession); err == nil {
+		t.Error("expected an error for fired timers without timer-ids")
+	}
+}
@@ -0,0 +1,101 @@
+package time
+
+import (
+	"os"
+	"time"
+)
+
+// The broker counts the time in nanoseconds from 0, the start of the
+// simulation, which would make dates in January 1970. Config.Epoch moves
+// that start to another date, and Config.Zone gives the dates a zone which
+// does not depend on the machine. Both only change the wall clock reading
+// of the times : durations, timers and monotonic readings still follow the
+// time of the broker.
+
+// calendar turns the time of the clock of a requester into dates.
+type calendar struct {
+	// sec and nsec are the epoch, as a Unix time.
+	sec, nsec int64
+	// zone is the location of the dates, nil for Local.
+	zone *time.Location
+	// mono tells whether the dates carry a monotonic reading of the
+	// clock.
+	mono bool
+}
+
+// newCalendar returns the calendar set up by c. The epoch and the
+// monotonic readings do not apply to ModeReal and ModeScaled, whose clocks
+// start from the wall clock.
+func newCalendar(c Config) *calendar {
+	cal := &calendar{zone: c.Zone}
+	if c.Mode != ModeReal && c.Mode != ModeScaled {
+		cal.mono = true
+		if !c.Epoch.IsZero() {
+			cal.sec, cal.nsec = c.Epoch.Unix(), int64(c.Epoch.Nanosecond())
+		}
+	}
+	return cal
+}
+
+// wall returns the wall clock reading at t on the clock.
+func (cal *calendar) wall(t int64) (sec int64, nsec int32) {
+	sec, n := cal.sec+t/1e9, cal.nsec+t%1e9
+	switch {
+	case n >= 1e9:
+		sec, n = sec+1, n-1e9
+	case n < 0:
+		sec, n = sec-1, n+1e9
+	}
+	return sec, int32(n)
+}
+
+// date returns the Time at the given wall clock reading, with the
+// monotonic reading mono if the calendar has them.
+func (cal *calendar) date(sec int64, nsec int32, mono int64) time.Time {
+	t := time.Unix(sec, int64(nsec))
+	if cal.zone != nil {
+		t = t.In(cal.zone)
+	}
+	if !cal.mono {
+		return t
+	}
+	return withMonotonic(t, mono)
+}
+
+// at returns the Time at t on the clock.
+func (cal *calendar) at(t int64) time.Time {
+	sec, nsec := cal.wall(t)
+	return cal.date(sec, nsec, t)
+}
+
+// unixCalendar is the calendar until a requester is configured.
+var unixCalendar = &calendar{mono: true}
+
+// calendar returns the calendar of r, set up when its loop starts.
+func (r *Requester) calendar() *calendar {
+	if cal, ok := r.cal.Load().(*calendar); ok {
+		return cal
+	}
+	return unixCalendar
+}
+
+// setLocal makes zone the Local location of this package. The Local of the
+// standard package is left alone : it belongs to the whole process, and
+// would race with every goroutine formatting a date.
+func setLocal(zone *time.Location) {
+	if zone != nil {
+		Local = zone
+	}
+}
+
+// envLocal returns the zone named by BATSKY_ZONE, read before any goroutine
+// uses Local, or the Local of the standard package. An invalid name is
+// reported along with the rest of the configuration, by loadConfig.
+func envLocal() *time.Location {
+	if v := os.Getenv("BATSKY_ZONE"); v != "" {
+		if zone, err := time.LoadLocation(v); err == nil {
+			return zone
+		}
+	}
+	return time.Local
+}
@@ -0,0 +1,92 @@
+package time
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCalendar(t *testing.T) {
+	epoch := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	zone := time.FixedZone("CET", 3600)
+	c := DefaultConfig()
+	c.Mode, c.Epoch, c.Zone = ModeVirtual, epoch, zone
+	r, err := NewRequester(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Shutdown(context.Background())
+
+	start := r.Now()
+	if !start.Equal(epoch) || start.Location() != zone {
+		t.Errorf("got %v at the start, want %v in %v", start, epoch, zone)
+	}
+	if start == start.Round(0) {
+		t.Errorf("got %v, without a monotonic reading", start)
+	}
+	timer := r.NewTimer(time.Second)
+	r.Advance(1500 * time.Millisecond)
+	if got := <-timer.C; !got.Equal(epoch.Add(time.Second)) || got.Location() != zone {
+		t.Errorf("timer sent %v, want %v in %v", got, epoch.Add(time.Second), zone)
+	}
+	if d := r.Now().Sub(start); d != 1500*time.Millisecond {
+		t.Errorf("got %v elapsed, want %v", d, 1500*time.Millisecond)
+	}
+	if got := r.RequestTime(0); got != int64(1500*time.Millisecond) {
+		t.Errorf("got %d from the clock, want the time since the start", got)
+	}
+}
+
+func TestCalendarWall(t *testing.T) {
+	epoch := time.Unix(100, 600000000)
+	cal := newCalendar(Config{Epoch: epoch})
+	for _, test := range []struct {
+		t    int64
+		sec  int64
+		nsec int32
+	}{
+		{0, 100, 600000000},
+		{300000000, 100, 900000000},
+		{500000000, 101, 100000000},
+		{-700000000, 99, 900000000},
+		{2e9, 102, 600000000},
+	} {
+		if sec, nsec := cal.wall(test.t); sec != test.sec || nsec != test.nsec {
+			t.Errorf("wall(%d) = %d, %d, want %d, %d", test.t, sec, nsec, test.sec, test.nsec)
+		}
+	}
+
+	// The clocks of ModeReal and ModeScaled already tell the date.
+	for _, mode := range []Mode{ModeReal, ModeScaled} {
+		if sec, _ := newCalendar(Config{Mode: mode, Epoch: epoch}).wall(0); sec != 0 {
+			t.Errorf("%s: got %d at time 0, want the Unix epoch", mode, sec)
+		}
+	}
+}
+
+func TestSetLocal(t *testing.T) {
+	local, stdLocal := Local, time.Local
+	defer func() { Local = local }()
+
+	setLocal(nil)
+	if Local != local {
+		t.Error("a nil zone changed Local")
+	}
+	zone := time.FixedZone("simulated", -3*3600)
+	setLocal(zone)
+	if Local != zone {
+		t.Errorf("got Local %v, want %v", Local, zone)
+	}
+	if time.Local != stdLocal {
+		t.Error("the Local of the standard package changed")
+	}
+	if loc := Unix(0, 0).Location(); loc != zone {
+		t.Errorf("got dates in %v, want %v", loc, zone)
+	}
+	os.Setenv("BATSKY_ZONE", "UTC")
+	defer os.Unsetenv("BATSKY_ZONE")
+	if loc := envLocal(); loc != time.UTC {
+		t.Errorf("got Local %v from the environment, want %v", loc, time.UTC)
+	}
+}
@@ -0,0 +1,111 @@
+package time
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// In ModeReal, the requester forwards to the standard package : Now is
+// time.Now, and Sleep, timers and tickers are the standard ones. The loop
+// never starts.
+//
+// In ModeScaled, and when the broker is left behind, the requester loop
+// runs the timers on a clock of its own, derived from the wall clock.
+
+// real reports whether r forwards to the standard package.
+func (r *Requester) real() bool {
+	return r.config().Mode == ModeReal
+}
+
+// realNow returns the current time of the standard package, in the zone of
+// r if it has one, and whether r is in ModeReal.
+func (r *Requester) realNow() (time.Time, bool) {
+	c := r.config()
+	if c.Mode != ModeReal {
+		return time.Time{}, false
+	}
+	t := time.Now()
+	if c.Zone != nil {
+		t = t.In(c.Zone)
+	}
+	return t, true
+}
+
+// localClock is a clock derived from the wall clock. It reads base at
+// start, and goes scale times as fast as the wall clock from then on.
+type localClock struct {
+	base  int64
+	start time.Time
+	scale float64
+}
+
+// newLocalClock returns the clock of c, in ModeScaled.
+func newLocalClock(c Config) localClock {
+	scale := c.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	now := time.Now()
+	return localClock{base: now.UnixNano(), start: now, scale: scale}
+}
+
+// wallClockFrom returns a clock going at the speed of the wall clock, from
+// base.
+func wallClockFrom(base int64) localClock {
+	return localClock{base: base, start: time.Now(), scale: 1}
+}
+
+// now returns the time of the clock, in nanoseconds.
+func (c localClock) now() int64 {
+	return c.base + int64(float64(time.Since(c.start))*c.scale)
+}
+
+// wall returns how long d on the clock is by the wall clock.
+func (c localClock) wall(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / c.scale)
+}
+
+func (c localClock) String() string {
+	return fmt.Sprintf("a clock going %v times as fast as the wall clock, from %v", c.scale, time.Unix(0, c.base).UTC())
+}
+
+// runClock answers the requests and runs the timers on clk, until the loop
+// is shut down.
+func (l *loop) runClock(c Config, clk localClock) {
+	r := l.r
+	c.logf("Running the timers on %v", clk)
+	r.dropEntries(true)
+	defer r.dropEntries(false)
+	wake := time.NewTimer(0)
+	defer wake.Stop()
+	for {
+		now := clk.now()
+		// The clock never goes backwards.
+		if last := atomic.LoadInt64(&r.lastNow); now < last {
+			now = last
+		}
+		r.runTimers(now, nil)
+		for _, m := range l.pending {
+			m.reply <- now
+		}
+		l.pending = l.pending[:0]
+
+		// Sleep until the next timer is due, or a new one is added.
+		if !wake.Stop() {
+			select {
+			case <-wake.C:
+			default:
+			}
+		}
+		wake.Reset(clk.wall(r.untilNextTimer(now)))
+		select {
+		case m := <-l.req:
+			l.pending = append(l.pending, m)
+		case <-r.timerAdded:
+		case <-wake.C:
+		case <-l.stop:
+			return
+		}
+	}
+}
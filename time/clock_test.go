@@ -0,0 +1,80 @@
+package time
+
+import (
+	"testing"
+	"time"
+)
+
+func TestModeReal(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode = ModeReal })
+
+	before := time.Now()
+	now := r.Now()
+	if now.Before(before.Round(0)) || now.After(time.Now()) {
+		t.Errorf("got time %v, want about %v", now, before)
+	}
+	r.Sleep(10 * time.Millisecond)
+	if d := time.Since(before); d < 10*time.Millisecond {
+		t.Errorf("slept for %v, want at least 10ms", d)
+	}
+
+	ticker := r.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; i < 3; i++ {
+		<-ticker.C
+	}
+	ticker.Reset(time.Millisecond)
+	<-ticker.C
+
+	timer := r.NewTimer(time.Hour)
+	if !timer.Reset(time.Millisecond) {
+		t.Error("Reset of a waiting timer returned false")
+	}
+	<-timer.C
+	fired := make(chan struct{})
+	r.AfterFunc(time.Millisecond, func() { close(fired) })
+	<-fired
+
+	// All of it is the standard package.
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+	if r.lifecycle.l != nil {
+		t.Error("the requester loop started")
+	}
+}
+
+func TestModeScaled(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.Scale = ModeScaled, 100 })
+
+	start := time.Now()
+	before := r.Now()
+	if before != before.Round(0) {
+		t.Error("scaled time has a monotonic reading")
+	}
+	r.Sleep(time.Second)
+	if d := time.Since(start); d >= 500*time.Millisecond {
+		t.Errorf("slept 1s for %v by the wall clock, want about 10ms", d)
+	}
+	if d := r.Now().Sub(before); d < time.Second {
+		t.Errorf("slept for %v, want at least 1s", d)
+	}
+
+	// Without a broker, stopped timers leave nothing to send behind.
+	for i := 0; i < 1000; i++ {
+		r.NewTimer(time.Hour).Stop()
+	}
+	r.entries.Lock()
+	n := len(r.entries.l)
+	r.entries.Unlock()
+	if n != 0 {
+		t.Errorf("%d timer entries queued", n)
+	}
+
+	// Slower than the wall clock.
+	r, _ = testRequester(t, func(c *Config) { c.Mode, c.Scale = ModeScaled, 0.5 })
+	start = time.Now()
+	r.Sleep(10 * time.Millisecond)
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("slept 10ms for %v by the wall clock, want at least 20ms", d)
+	}
+}
@@ -0,0 +1,405 @@
+package time
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role tells whether the requester binds its endpoint and waits for the
+// broker to connect, or connects to a broker bound on the endpoint.
+type Role string
+
+const (
+	RoleBind    Role = "bind"
+	RoleConnect Role = "connect"
+)
+
+// Mode tells where the time of a requester comes from.
+type Mode string
+
+const (
+	// ModeSimulated asks the broker for the time.
+	ModeSimulated Mode = "simulated"
+
+	// ModeReal forwards to the standard library : Now is time.Now, and
+	// timers and tickers are the standard ones. Nothing goes through the
+	// requester loop.
+	ModeReal Mode = "real"
+
+	// ModeScaled runs a clock derived from the wall clock, going Scale
+	// times as fast.
+	ModeScaled Mode = "scaled"
+
+	// ModeVirtual runs a virtual clock, which only moves forward with
+	// Advance, or on its own to the next timer when AutoAdvance is set.
+	// It needs no broker, for tests.
+	ModeVirtual Mode = "virtual"
+)
+
+// ErrorPolicy tells what a requester does when its exchanges with the
+// broker fail. In all cases, the error is first reported to the error
+// handler of the requester.
+type ErrorPolicy string
+
+const (
+	// OnErrorPanic gives up on the broker : the callers waiting for the
+	// time get the error, which makes RequestTime, Now, Sleep, etc. panic.
+	// The next time request starts over with a new connection.
+	OnErrorPanic ErrorPolicy = "panic"
+
+	// OnErrorWallClock leaves the broker behind and goes on with a clock
+	// running at the speed of the wall clock, from the last time received
+	// from the broker, until the requester is shut down.
+	OnErrorWallClock ErrorPolicy = "wallclock"
+
+	// OnErrorRetry opens a new connection with the broker and sends the
+	// requests again. Callers are blocked in the meantime.
+	OnErrorRetry ErrorPolicy = "retry"
+)
+
+// Config holds the settings of a requester. The ones of the default
+// requester are read once, when the first time request is made, either
+// from Configure or from the environment. Other requesters are given
+// theirs by NewRequester.
+type Config struct {
+	// Mode is where the time comes from. Empty means ModeSimulated, the
+	// other settings only matter in that mode.
+	// Environment variable : BATSKY_MODE
+	Mode Mode
+
+	// Scale is how many times faster than the wall clock the time goes
+	// in ModeScaled : 2 is twice as fast, 0.5 half as fast. 0 means 1.
+	// Environment variable : BATSKY_SCALE
+	Scale float64
+
+	// AutoAdvance moves the time of ModeVirtual forward to the next timer
+	// when nothing asked for the time for a moment.
+	// Environment variable : BATSKY_AUTO_ADVANCE, as a boolean
+	AutoAdvance bool
+
+	// Epoch is the date of the start of the simulation, its time 0. The
+	// zero Time means January 1, 1970 UTC, the Unix epoch. ModeReal and
+	// ModeScaled ignore it.
+	// Environment variable : BATSKY_EPOCH, in RFC 3339 format
+	Epoch time.Time
+
+	// Zone is the location of the times of the requester. For the default
+	// requester, it also replaces the Local of this package, from the start
+	// when it comes from the environment, or from Configure. The Local of
+	// the standard package is left alone. nil keeps Local.
+	// Environment variable : BATSKY_ZONE, a name for LoadLocation
+	Zone *time.Location
+
+	// Endpoint is the zmq style address of the broker exchanges, like
+	// tcp://127.0.0.1:27000, ipc:///tmp/batsky.sock for a Unix domain
+	// socket, or inproc://batsky for a broker in the same binary (see
+	// DialInproc).
+	// Environment variable : BATSKY_ENDPOINT
+	Endpoint string
+
+	// Role is either RoleBind or RoleConnect. It does not matter for
+	// inproc endpoints.
+	// Environment variable : BATSKY_ROLE
+	Role Role
+
+	// Transport names the transport implementation, see transports.
+	// Empty means the default one.
+	// Environment variable : BATSKY_TRANSPORT
+	Transport string
+
+	// Linger is how long pending messages are kept around when the socket
+	// is closed. A negative value waits forever.
+	// Environment variable : BATSKY_LINGER, as a duration (1s, 500ms...)
+	Linger time.Duration
+
+	// HWM is the high water mark of the socket, in messages. 0 means no
+	// limit. Transports which never queue messages ignore it.
+	// Environment variable : BATSKY_HWM
+	HWM int
+
+	// RecvTimeout bounds the time spent waiting for a message from the
+	// broker. 0 means no timeout.
+	// Environment variable : BATSKY_RECV_TIMEOUT, as a duration
+	RecvTimeout time.Duration
+
+	// HandshakeTimeout, ReplyTimeout and AckTimeout bound the phases of
+	// an exchange : waiting for the broker to be ready, for the time once
+	// the batch is sent, and sending the ack. A phase taking longer fails
+	// with ErrTimeout, which is handled like losing the broker. 0 means no
+	// timeout.
+	// Environment variables : BATSKY_HANDSHAKE_TIMEOUT,
+	// BATSKY_REPLY_TIMEOUT and BATSKY_ACK_TIMEOUT, as durations
+	HandshakeTimeout time.Duration
+	ReplyTimeout     time.Duration
+	AckTimeout       time.Duration
+
+	// WatchdogInterval is how often the watchdog checks on the requester
+	// loop. When the loop has been waiting for the broker for longer than
+	// that, it logs how long, the callers blocked and the pending timers.
+	// 0 disables the watchdog.
+	// Environment variable : BATSKY_WATCHDOG, as a duration
+	WatchdogInterval time.Duration
+
+	// WatchdogAbort makes the watchdog panic after its report, crashing a
+	// stuck simulation instead of leaving it hanging.
+	// Environment variable : BATSKY_WATCHDOG_ABORT, as a boolean
+	WatchdogAbort bool
+
+	// Logger receives the messages of the requester loop. nil prints them
+	// on the standard output.
+	Logger *log.Logger
+
+	// Metadata is sent to brokers supporting it when the session opens,
+	// on top of the pid and program name of the requester.
+	// Environment variable : BATSKY_METADATA, as key=value pairs
+	// separated by commas
+	Metadata map[string]string
+
+	// ReconnectTimeout is how long the requester keeps trying to
+	// reconnect after losing the broker, before OnError applies. 0
+	// disables reconnecting, a negative value tries forever.
+	// Environment variable : BATSKY_RECONNECT_TIMEOUT, as a duration
+	ReconnectTimeout time.Duration
+
+	// OnError is what the requester does when its exchanges with the
+	// broker fail, and it does not or can't reconnect. Empty means
+	// OnErrorPanic.
+	// Environment variable : BATSKY_ON_ERROR
+	OnError ErrorPolicy
+
+	// ErrorHandler is told about the errors of the requester loop. nil
+	// prints them.
+	ErrorHandler func(err error)
+}
+
+// DefaultConfig returns the settings used when nothing else is
+// specified : binding tcp://127.0.0.1:27000, where Batkube expects to find
+// the requester.
+func DefaultConfig() Config {
+	return Config{
+		Endpoint: "tcp://127.0.0.1:27000",
+		Role:     RoleBind,
+		Linger:   -1,
+		HWM:      1000,
+
+		ReconnectTimeout: time.Minute,
+	}
+}
+
+// Validate reports the first invalid setting of c, if any.
+func (c Config) Validate() error {
+	switch c.Mode {
+	case "", ModeSimulated, ModeReal, ModeScaled, ModeVirtual:
+	default:
+		return fmt.Errorf("invalid mode %q : expected %s, %s, %s or %s", c.Mode, ModeSimulated, ModeReal, ModeScaled, ModeVirtual)
+	}
+	if c.Scale < 0 {
+		return fmt.Errorf("invalid scale %v : must not be negative", c.Scale)
+	}
+	i := strings.Index(c.Endpoint, "://")
+	if i <= 0 || i+3 == len(c.Endpoint) {
+		return fmt.Errorf("invalid endpoint %q : expected scheme://address", c.Endpoint)
+	}
+	switch scheme := c.Endpoint[:i]; scheme {
+	case "tcp", "ipc", "inproc":
+	default:
+		return fmt.Errorf("invalid endpoint %q : unsupported scheme %s", c.Endpoint, scheme)
+	}
+	if c.Role != RoleBind && c.Role != RoleConnect {
+		return fmt.Errorf("invalid role %q : expected %s or %s", c.Role, RoleBind, RoleConnect)
+	}
+	if c.Transport != "" {
+		if _, ok := transports[c.Transport]; !ok {
+			return fmt.Errorf("unknown transport %q (is it built in?)", c.Transport)
+		}
+	}
+	if c.HWM < 0 {
+		return fmt.Errorf("invalid HWM %d : must not be negative", c.HWM)
+	}
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"receive timeout", c.RecvTimeout},
+		{"handshake timeout", c.HandshakeTimeout},
+		{"reply timeout", c.ReplyTimeout},
+		{"ack timeout", c.AckTimeout},
+		{"watchdog interval", c.WatchdogInterval},
+	} {
+		if t.d < 0 {
+			return fmt.Errorf("invalid %s %v : must not be negative", t.name, t.d)
+		}
+	}
+	switch c.OnError {
+	case "", OnErrorPanic, OnErrorWallClock, OnErrorRetry:
+	default:
+		return fmt.Errorf("invalid error policy %q : expected %s, %s or %s", c.OnError, OnErrorPanic, OnErrorWallClock, OnErrorRetry)
+	}
+	return nil
+}
+
+// ConfigFromEnv returns the default settings overridden by the BATSKY_*
+// environment variables.
+func ConfigFromEnv() (Config, error) {
+	c := DefaultConfig()
+	var err error
+	if v := os.Getenv("BATSKY_MODE"); v != "" {
+		c.Mode = Mode(v)
+	}
+	if v := os.Getenv("BATSKY_SCALE"); v != "" {
+		if c.Scale, err = strconv.ParseFloat(v, 64); err != nil {
+			return c, fmt.Errorf("BATSKY_SCALE: %v", err)
+		}
+	}
+	if v := os.Getenv("BATSKY_AUTO_ADVANCE"); v != "" {
+		if c.AutoAdvance, err = strconv.ParseBool(v); err != nil {
+			return c, fmt.Errorf("BATSKY_AUTO_ADVANCE: %v", err)
+		}
+	}
+	if v := os.Getenv("BATSKY_EPOCH"); v != "" {
+		if c.Epoch, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return c, fmt.Errorf("BATSKY_EPOCH: %v", err)
+		}
+	}
+	if v := os.Getenv("BATSKY_ZONE"); v != "" {
+		if c.Zone, err = time.LoadLocation(v); err != nil {
+			return c, fmt.Errorf("BATSKY_ZONE: %v", err)
+		}
+	}
+	if v := os.Getenv("BATSKY_ENDPOINT"); v != "" {
+		c.Endpoint = v
+	}
+	if v := os.Getenv("BATSKY_ROLE"); v != "" {
+		c.Role = Role(v)
+	}
+	if v := os.Getenv("BATSKY_TRANSPORT"); v != "" {
+		c.Transport = v
+	}
+	if v := os.Getenv("BATSKY_LINGER"); v != "" {
+		if c.Linger, err = time.ParseDuration(v); err != nil {
+			return c, fmt.Errorf("BATSKY_LINGER: %v", err)
+		}
+	}
+	if v := os.Getenv("BATSKY_HWM"); v != "" {
+		if c.HWM, err = strconv.Atoi(v); err != nil {
+			return c, fmt.Errorf("BATSKY_HWM: %v", err)
+		}
+	}
+	if v := os.Getenv("BATSKY_RECV_TIMEOUT"); v != "" {
+		if c.RecvTimeout, err = time.ParseDuration(v); err != nil {
+			return c, fmt.Errorf("BATSKY_RECV_TIMEOUT: %v", err)
+		}
+	}
+	for _, d := range []struct {
+		name string
+		d    *time.Duration
+	}{
+		{"BATSKY_HANDSHAKE_TIMEOUT", &c.HandshakeTimeout},
+		{"BATSKY_REPLY_TIMEOUT", &c.ReplyTimeout},
+		{"BATSKY_ACK_TIMEOUT", &c.AckTimeout},
+		{"BATSKY_WATCHDOG", &c.WatchdogInterval},
+	} {
+		if v := os.Getenv(d.name); v != "" {
+			if *d.d, err = time.ParseDuration(v); err != nil {
+				return c, fmt.Errorf("%s: %v", d.name, err)
+			}
+		}
+	}
+	if v := os.Getenv("BATSKY_WATCHDOG_ABORT"); v != "" {
+		if c.WatchdogAbort, err = strconv.ParseBool(v); err != nil {
+			return c, fmt.Errorf("BATSKY_WATCHDOG_ABORT: %v", err)
+		}
+	}
+	if v := os.Getenv("BATSKY_RECONNECT_TIMEOUT"); v != "" {
+		if c.ReconnectTimeout, err = time.ParseDuration(v); err != nil {
+			return c, fmt.Errorf("BATSKY_RECONNECT_TIMEOUT: %v", err)
+		}
+	}
+	if v := os.Getenv("BATSKY_ON_ERROR"); v != "" {
+		c.OnError = ErrorPolicy(v)
+	}
+	if v := os.Getenv("BATSKY_METADATA"); v != "" {
+		c.Metadata = make(map[string]string)
+		for _, kv := range strings.Split(v, ",") {
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				return c, fmt.Errorf("BATSKY_METADATA: expected key=value, got %q", kv)
+			}
+			c.Metadata[kv[:i]] = kv[i+1:]
+		}
+	}
+	return c, c.Validate()
+}
+
+var (
+	configMu sync.Mutex
+	config   *Config
+)
+
+// Configure sets the settings of the default requester. It must be called
+// before the first time request, since the settings are only read once.
+// Since it sets Local to c.Zone, it must also be called before the
+// goroutines using Local start.
+func Configure(c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	if config != nil {
+		return errors.New("the requester is already configured")
+	}
+	config = &c
+	setLocal(c.Zone)
+	return nil
+}
+
+// handleError reports an error of the requester loop.
+func (c Config) handleError(err error) {
+	if c.ErrorHandler != nil {
+		c.ErrorHandler(err)
+		return
+	}
+	c.logf("Requester error : %v", err)
+}
+
+// logf logs a message of the requester loop.
+func (c Config) logf(format string, args ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, args...)
+		return
+	}
+	fmt.Printf(format+"\n", args...)
+}
+
+// metadata returns what the requester says about itself to the broker.
+func (c Config) metadata() map[string]string {
+	m := defaultMetadata()
+	for k, v := range c.Metadata {
+		m[k] = v
+	}
+	return m
+}
+
+// loadConfig returns the requester settings, reading them from the
+// environment if Configure was not called. Invalid settings are reported
+// and replaced by the default ones.
+func loadConfig() Config {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if config == nil {
+		c, err := ConfigFromEnv()
+		if err != nil {
+			fmt.Println("Invalid requester configuration, using the defaults :", err)
+			c = DefaultConfig()
+		}
+		config = &c
+	}
+	return *config
+}
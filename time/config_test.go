@@ -0,0 +1,137 @@
+package time
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(c *Config)
+		valid bool
+	}{
+		{"default", func(c *Config) {}, true},
+		{"connect", func(c *Config) { c.Role = RoleConnect }, true},
+		{"no scheme", func(c *Config) { c.Endpoint = "127.0.0.1:27000" }, false},
+		{"no address", func(c *Config) { c.Endpoint = "tcp://" }, false},
+		{"bad scheme", func(c *Config) { c.Endpoint = "udp://127.0.0.1:27000" }, false},
+		{"bad role", func(c *Config) { c.Role = "listen" }, false},
+		{"bad transport", func(c *Config) { c.Transport = "carrier-pigeon" }, false},
+		{"negative HWM", func(c *Config) { c.HWM = -1 }, false},
+		{"negative timeout", func(c *Config) { c.RecvTimeout = -time.Second }, false},
+		{"negative reply timeout", func(c *Config) { c.ReplyTimeout = -time.Second }, false},
+		{"watchdog", func(c *Config) { c.WatchdogInterval = time.Minute }, true},
+		{"retry", func(c *Config) { c.OnError = OnErrorRetry }, true},
+		{"bad error policy", func(c *Config) { c.OnError = "ignore" }, false},
+		{"scaled", func(c *Config) { c.Mode, c.Scale = ModeScaled, 10 }, true},
+		{"bad mode", func(c *Config) { c.Mode = "fast" }, false},
+		{"virtual", func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, true }, true},
+		{"negative scale", func(c *Config) { c.Scale = -1 }, false},
+	}
+	for _, test := range tests {
+		c := DefaultConfig()
+		test.edit(&c)
+		if err := c.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, want valid = %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func setenv(t *testing.T, env map[string]string) {
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func unsetenv(env map[string]string) {
+	for k := range env {
+		os.Unsetenv(k)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	env := map[string]string{
+		"BATSKY_ENDPOINT":     "tcp://10.0.0.1:27001",
+		"BATSKY_ROLE":         "connect",
+		"BATSKY_LINGER":       "2s",
+		"BATSKY_HWM":          "10",
+		"BATSKY_RECV_TIMEOUT": "1m",
+		"BATSKY_METADATA":     "scheduler=default,run=3",
+		"BATSKY_ON_ERROR":     "wallclock",
+
+		"BATSKY_RECONNECT_TIMEOUT": "-1s",
+		"BATSKY_HANDSHAKE_TIMEOUT": "1h",
+		"BATSKY_REPLY_TIMEOUT":     "10s",
+		"BATSKY_ACK_TIMEOUT":       "1s",
+		"BATSKY_WATCHDOG":          "30s",
+		"BATSKY_WATCHDOG_ABORT":    "true",
+		"BATSKY_MODE":              "scaled",
+		"BATSKY_AUTO_ADVANCE":      "1",
+		"BATSKY_SCALE":             "0.5",
+		"BATSKY_EPOCH":             "2026-01-01T00:00:00Z",
+		"BATSKY_ZONE":              "UTC",
+	}
+	setenv(t, env)
+	defer unsetenv(env)
+
+	c, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		Endpoint:    "tcp://10.0.0.1:27001",
+		Role:        RoleConnect,
+		Linger:      2 * time.Second,
+		HWM:         10,
+		RecvTimeout: time.Minute,
+		Metadata:    map[string]string{"scheduler": "default", "run": "3"},
+		OnError:     OnErrorWallClock,
+
+		ReconnectTimeout: -time.Second,
+		HandshakeTimeout: time.Hour,
+		ReplyTimeout:     10 * time.Second,
+		AckTimeout:       time.Second,
+		WatchdogInterval: 30 * time.Second,
+		WatchdogAbort:    true,
+		Mode:             ModeScaled,
+		AutoAdvance:      true,
+		Scale:            0.5,
+		Epoch:            time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Zone:             time.UTC,
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+}
+
+func TestConfigFromEnvInvalid(t *testing.T) {
+	for k, v := range map[string]string{
+		"BATSKY_ROLE":         "both",
+		"BATSKY_HWM":          "lots",
+		"BATSKY_RECV_TIMEOUT": "5",
+		"BATSKY_METADATA":     "scheduler",
+		"BATSKY_ON_ERROR":     "ignore",
+
+		"BATSKY_RECONNECT_TIMEOUT": "soon",
+		"BATSKY_ACK_TIMEOUT":       "-1s",
+		"BATSKY_WATCHDOG":          "often",
+		"BATSKY_WATCHDOG_ABORT":    "maybe",
+		"BATSKY_MODE":              "fast",
+		"BATSKY_SCALE":             "x10",
+		"BATSKY_AUTO_ADVANCE":      "sometimes",
+		"BATSKY_EPOCH":             "2026-01-01",
+		"BATSKY_ZONE":              "Nowhere/Atlantis",
+	} {
+		env := map[string]string{k: v}
+		setenv(t, env)
+		if _, err := ConfigFromEnv(); err == nil {
+			t.Errorf("%s=%s: expected an error", k, v)
+		}
+		unsetenv(env)
+	}
+}
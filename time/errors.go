@@ -0,0 +1,53 @@
+package time
+
+import "errors"
+
+// Errors returned by RequestTimeErr and NowErr. The errors of the requester
+// loop wrap either ErrBrokerUnavailable or ErrProtocol, along with their
+// cause, and can be told apart with errors.Is.
+var (
+	// ErrBrokerUnavailable means the broker could not be reached, or the
+	// connection with it was lost.
+	ErrBrokerUnavailable = errors.New("time: broker unavailable")
+
+	// ErrProtocol means the broker sent something the requester could not
+	// make sense of.
+	ErrProtocol = errors.New("time: protocol error")
+
+	// ErrTimeout means a phase of an exchange with the broker took longer
+	// than its timeout, see Config.ReplyTimeout. It comes along with
+	// ErrBrokerUnavailable.
+	ErrTimeout = errors.New("time: broker exchange timed out")
+
+	// ErrShutdown means the requester was shut down before it could get
+	// the time.
+	ErrShutdown = errors.New("time: requester shut down")
+)
+
+// requesterError is an error of the requester loop, of one of the kinds
+// above.
+type requesterError struct {
+	kind error
+	op   string
+	err  error
+}
+
+func (e *requesterError) Error() string {
+	return e.kind.Error() + ": " + e.op + ": " + e.err.Error()
+}
+
+func (e *requesterError) Is(target error) bool { return target == e.kind }
+
+func (e *requesterError) Unwrap() error { return e.err }
+
+// brokerError reports the failure of op because the broker can't be
+// reached.
+func brokerError(op string, err error) error {
+	return &requesterError{kind: ErrBrokerUnavailable, op: op, err: err}
+}
+
+// protocolError reports the failure of op because of an unexpected
+// message.
+func protocolError(op string, err error) error {
+	return &requesterError{kind: ErrProtocol, op: op, err: err}
+}
@@ -0,0 +1,95 @@
+package time
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOnErrorPanic(t *testing.T) {
+	r, errs := testRequester(t, func(c *Config) { c.OnError = OnErrorPanic })
+	b := startFakeBrokerFor(t, r)
+
+	got := make(chan error)
+	go func() {
+		_, err := r.RequestTimeErr(5)
+		got <- err
+	}()
+	b.takeRequest()
+	b.tr.toRequester <- []byte("not a time")
+
+	if err := <-got; !errors.Is(err, ErrProtocol) {
+		t.Errorf("got error %v, want a protocol error", err)
+	}
+	if err := <-errs; !errors.Is(err, ErrProtocol) {
+		t.Errorf("the handler got %v, want a protocol error", err)
+	}
+
+	// The next request starts over.
+	stop := b.run(1)
+	defer stop()
+	if _, err := r.RequestTimeErr(0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOnErrorPanicPanics(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.OnError = OnErrorPanic })
+	b := startFakeBrokerFor(t, r)
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		r.RequestTime(5)
+	}()
+	b.takeRequest()
+	b.tr.toRequester <- []byte("not a time")
+	err, _ := (<-panicked).(error)
+	if !errors.Is(err, ErrProtocol) {
+		t.Errorf("got panic %v, want a protocol error", err)
+	}
+}
+
+func TestOnErrorWallClock(t *testing.T) {
+	r, errs := testRequester(t, func(c *Config) { c.OnError = OnErrorWallClock })
+	b := startFakeBrokerFor(t, r)
+
+	b.exchange(int64(time.Hour))
+	b.tr.toRequester <- []byte("hello?")
+	<-errs
+
+	// Time goes on from the last time received from the broker.
+	before := r.RequestTime(0)
+	if before < int64(time.Hour) {
+		t.Errorf("got time %v, want at least 1h", time.Duration(before))
+	}
+	r.Sleep(time.Millisecond)
+	if after := r.RequestTime(0); after < before+int64(time.Millisecond) {
+		t.Errorf("slept from %v to %v, want at least 1ms", time.Duration(before), time.Duration(after))
+	}
+}
+
+func TestOnErrorRetry(t *testing.T) {
+	r, errs := testRequester(t, func(c *Config) { c.OnError = OnErrorRetry })
+	b := startFakeBrokerFor(t, r)
+
+	got := make(chan int64)
+	go func() { got <- r.RequestTime(5) }()
+	b.takeRequest()
+	b.tr.toRequester <- []byte("not a time")
+	if err := <-errs; !errors.Is(err, ErrProtocol) {
+		t.Errorf("the handler got %v, want a protocol error", err)
+	}
+
+	// The request is sent again, on a new connection.
+	if batch := b.exchangeUntil(42); len(batch) != 1 || batch[0].Duration != 5 {
+		t.Errorf("got batch %v, want the request again", batch)
+	}
+	if now := <-got; now != 42 {
+		t.Errorf("got time %d, want 42", now)
+	}
+	if opens := atomic.LoadInt32(&b.opens); opens != 2 {
+		t.Errorf("the transport was opened %d times, want 2", opens)
+	}
+}
@@ -0,0 +1,79 @@
+package time
+
+import "testing"
+
+func TestInproc(t *testing.T) {
+	const endpoint = "inproc://test-inproc"
+	b, err := DialInproc(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := openTransport(Config{Endpoint: endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	go func() {
+		for _, msg := range []string{"ready", "now"} {
+			if err := b.Send([]byte(msg)); err != nil {
+				t.Error(err)
+				return
+			}
+			reply, err := b.Recv()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(reply) != msg+" reply" {
+				t.Errorf("got reply %q to %s", reply, msg)
+			}
+		}
+	}()
+
+	msg, err := tr.RecvHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "ready" {
+		t.Fatalf("got handshake %q, want %q", msg, "ready")
+	}
+	if err = tr.SendBatch([]byte("ready reply")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = tr.RecvTime(); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "now" {
+		t.Fatalf("got time %q, want %q", msg, "now")
+	}
+	if err = tr.SendAck([]byte("now reply")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInprocClose(t *testing.T) {
+	const endpoint = "inproc://test-inproc-close"
+	b, err := DialInproc(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := openTransport(Config{Endpoint: endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if _, err = tr.RecvHandshake(); err != errInprocClosed {
+		t.Errorf("got error %v, want %v", err, errInprocClosed)
+	}
+
+	// The name is free again
+	b, err = DialInproc(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.pipe == tr.(*inprocTransport).pipe {
+		t.Error("closed endpoint was reused")
+	}
+}
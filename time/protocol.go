@@ -0,0 +1,167 @@
+package time
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Requester - broker protocol versions.
+//
+// Version 1 is the original protocol : every exchange starts with the
+// broker sending "ready", the requester answers with a json array of timer
+// durations, the broker sends the time as a little endian int64 and the
+// requester answers "done".
+//
+// From version 2 on, a broker opens the session with a hello message
+// holding its protocol version and the features it supports. The requester
+// answers with the version and features both ends agree on, then exchanges
+// go on like in version 1, modified by the negotiated features. Brokers
+// which go straight to "ready" are spoken to in version 1.
+const protocolVersion = 2
+
+// feature is a set of optional protocol features.
+type feature uint32
+
+const (
+	// Timers carry an identifier, and the broker tells which ones fired.
+	featureTimerIDs feature = 1 << iota
+
+	// Timers can be withdrawn from the broker. Requires timer-ids.
+	featureCancel
+
+	// Batches are binary encoded instead of json.
+	featureBinary
+
+	// Hello messages carry free form metadata about each end.
+	featureMetadata
+
+	// Batches tell whether the requester is idle, and when its next timer
+	// is due.
+	featureQuiescence
+)
+
+var featureNames = map[feature]string{
+	featureTimerIDs:   "timer-ids",
+	featureCancel:     "cancel",
+	featureBinary:     "binary",
+	featureMetadata:   "metadata",
+	featureQuiescence: "quiescence",
+}
+
+// supportedFeatures is the set of features implemented by the requester.
+var supportedFeatures = featureTimerIDs | featureCancel | featureBinary | featureMetadata | featureQuiescence
+
+func (f feature) has(g feature) bool {
+	return f&g == g
+}
+
+func (f feature) names() []string {
+	names := make([]string, 0, len(featureNames))
+	for g, name := range featureNames {
+		if f.has(g) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f feature) String() string {
+	if f == 0 {
+		return "none"
+	}
+	return strings.Join(f.names(), ",")
+}
+
+// parseFeatures ignores the features it does not know about, so that a
+// broker may implement more than the requester.
+func parseFeatures(names []string) feature {
+	var f feature
+	for _, name := range names {
+		for g, n := range featureNames {
+			if n == name {
+				f |= g
+			}
+		}
+	}
+	return f
+}
+
+// hello is the first message of a session, sent by the broker and answered
+// by the requester.
+type hello struct {
+	Version  int               `json:"version"`
+	Features []string          `json:"features"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// session holds what was agreed on with the broker.
+type session struct {
+	version      int
+	features     feature
+	peerMetadata map[string]string
+}
+
+// legacySession is the session with a broker which did not say hello.
+var legacySession = session{version: 1}
+
+// isHello tells whether a message opening an exchange is a hello, rather
+// than "ready".
+func isHello(msg []byte) bool {
+	return len(msg) > 0 && msg[0] == '{'
+}
+
+// negotiate returns the session agreed upon from the broker hello msg,
+// along with the reply to send back. metadata is sent along if the broker
+// supports it.
+func negotiate(msg []byte, metadata map[string]string) (session, []byte, error) {
+	var h hello
+	if err := json.Unmarshal(msg, &h); err != nil {
+		return legacySession, nil, fmt.Errorf("malformed hello %q: %v", msg, err)
+	}
+	if h.Version < 1 {
+		return legacySession, nil, fmt.Errorf("invalid protocol version %d", h.Version)
+	}
+	s := session{
+		version:      h.Version,
+		features:     parseFeatures(h.Features) & supportedFeatures,
+		peerMetadata: h.Metadata,
+	}
+	if s.version > protocolVersion {
+		s.version = protocolVersion
+	}
+	if s.version == 1 {
+		s.features = 0
+	}
+	if !s.features.has(featureTimerIDs) {
+		// There is nothing to cancel without identifiers.
+		s.features &^= featureCancel
+	}
+	reply := hello{
+		Version:  s.version,
+		Features: s.features.names(),
+	}
+	if s.features.has(featureMetadata) {
+		reply.Metadata = metadata
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return legacySession, nil, errors.New("error marshaling hello: " + err.Error())
+	}
+	return s, b, nil
+}
+
+// defaultMetadata describes the requester to the broker.
+func defaultMetadata() map[string]string {
+	m := map[string]string{
+		"pid": fmt.Sprint(os.Getpid()),
+	}
+	if len(os.Args) > 0 {
+		m["program"] = os.Args[0]
+	}
+	return m
+}
@@ -0,0 +1,53 @@
+package time
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	metadata := map[string]string{"pid": "42"}
+	tests := []struct {
+		hello    string
+		version  int
+		features feature
+		metadata map[string]string
+	}{
+		{`{"version":2,"features":["metadata"]}`, 2, featureMetadata, metadata},
+		{`{"version":2,"features":[]}`, 2, 0, nil},
+		{`{"version":2,"features":["metadata","teleportation"]}`, 2, featureMetadata, metadata},
+		{`{"version":2,"features":["binary"]}`, 2, featureBinary, nil},
+		{`{"version":2,"features":["timer-ids","cancel"]}`, 2, featureTimerIDs | featureCancel, nil},
+		{`{"version":2,"features":["cancel"]}`, 2, 0, nil},
+		{`{"version":1,"features":["metadata"]}`, 1, 0, nil},
+		{`{"version":99,"features":["metadata"]}`, protocolVersion, featureMetadata, metadata},
+	}
+	for _, test := range tests {
+		s, b, err := negotiate([]byte(test.hello), metadata)
+		if err != nil {
+			t.Errorf("%s: %v", test.hello, err)
+			continue
+		}
+		if s.version != test.version || s.features != test.features {
+			t.Errorf("%s: got version %d features %v, want %d %v", test.hello, s.version, s.features, test.version, test.features)
+		}
+		var reply hello
+		if err = json.Unmarshal(b, &reply); err != nil {
+			t.Errorf("%s: %v", test.hello, err)
+			continue
+		}
+		want := hello{Version: test.version, Features: test.features.names(), Metadata: test.metadata}
+		if !reflect.DeepEqual(reply, want) {
+			t.Errorf("%s: got reply %+v, want %+v", test.hello, reply, want)
+		}
+	}
+}
+
+func TestNegotiateInvalid(t *testing.T) {
+	for _, msg := range []string{`{"version":`, `{"features":[]}`, `{"version":-2}`} {
+		if _, _, err := negotiate([]byte(msg), nil); err == nil {
+			t.Errorf("%s: expected an error", msg)
+		}
+	}
+}
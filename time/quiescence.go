@@ -0,0 +1,124 @@
+package time
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The broker can't tell whether the scheduler is still computing, or is
+// waiting for timers and would not do anything before the next one fires.
+// The requester keeps track of the work in flight, so as to tell the
+// broker when it is idle, which lets the simulation jump to the next
+// event :
+//   - the callers waiting for the time, and the timers being started with
+//     the time they got,
+//   - the values sent on timer channels, until they are received or the
+//     time moves on : a value still there by then was most likely given up
+//     on, like the value of After in a select which took another case,
+//   - the functions of AfterFunc, until their goroutine starts,
+//   - the work marked with Busy.
+// Goroutines which are between time calls are only seen through Busy, or
+// when they ask for the time : a goroutine woken up by a timer may well
+// block in Sleep right away.
+
+// Busy marks the start of some work of the caller, for the default
+// requester. The requester is not idle until the returned function is
+// called.
+func Busy() (done func()) {
+	return defaultRequester.Busy()
+}
+
+// Busy marks the start of some work of the caller, like the package level
+// Busy.
+func (r *Requester) Busy() (done func()) {
+	atomic.AddInt32(&r.work, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { atomic.AddInt32(&r.work, -1) })
+	}
+}
+
+// Idle reports whether the default requester is idle : nothing is in
+// flight, and time may as well jump to the next timer.
+func Idle() bool {
+	return defaultRequester.Idle()
+}
+
+// Idle reports whether r is idle, like the package level Idle.
+func (r *Requester) Idle() bool {
+	if r.working() {
+		return false
+	}
+	r.sent.Lock()
+	defer r.sent.Unlock()
+	r.pruneSent()
+	return len(r.sent.m) == 0
+}
+
+// working reports whether there is work in flight, not counting the
+// values sent on timer channels, which may never be received.
+func (r *Requester) working() bool {
+	return atomic.LoadInt32(&r.work) > 0 || atomic.LoadInt32(&r.blocked) > 0
+}
+
+// pruneSent forgets about the timer channels which were received from, and
+// the ones which were sent a value before the current time. r.sent must be
+// locked.
+func (r *Requester) pruneSent() {
+	now := atomic.LoadInt64(&r.lastNow)
+	for c, at := range r.sent.m {
+		if len(c) == 0 || at < now {
+			delete(r.sent.m, c)
+		}
+	}
+	r.sent.kept = len(r.sent.m)
+}
+
+// status returns the status of r, for the broker. pending is how many
+// callers are part of the exchange in progress, which are not counted as
+// work in flight : their requests are in the batch.
+func (r *Requester) status(pending int) status {
+	st := status{NextWakeup: -1}
+	if when, ok := r.nextTimer(); ok {
+		st.NextWakeup = when
+	}
+	// The callers of the exchange get the time right after the batch,
+	// and go on with their work.
+	st.Idle = pending == 0 && r.Idle()
+	return st
+}
+
+// noteSent records that a value was sent on c at now, which wakes up the
+// goroutine receiving from it.
+func (r *Requester) noteSent(c chan time.Time, now int64) {
+	r.sent.Lock()
+	defer r.sent.Unlock()
+	if r.sent.m == nil {
+		r.sent.m = make(map[chan time.Time]int64)
+	}
+	// Pruning each time the channels double in number keeps the cost of
+	// a value constant.
+	if len(r.sent.m) >= 2*r.sent.kept+minSentPrune {
+		r.pruneSent()
+	}
+	if _, ok := r.sent.m[c]; !ok {
+		// Otherwise a ticker nobody received from yet, which keeps its
+		// first value.
+		r.sent.m[c] = now
+	}
+}
+
+// minSentPrune is how many timer channels noteSent records before pruning
+// them.
+const minSentPrune = 64
+
+// goFunc calls arg in its own goroutine, which is work of r until it
+// starts.
+func (r *Requester) goFunc(arg interface{}) {
+	atomic.AddInt32(&r.work, 1)
+	go func() {
+		atomic.AddInt32(&r.work, -1)
+		arg.(func())()
+	}()
+}
@@ -0,0 +1,124 @@
+package time
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdle(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, false })
+	if !r.Idle() {
+		t.Fatal("new requester is not idle")
+	}
+
+	done := r.Busy()
+	if r.Idle() {
+		t.Error("idle while busy")
+	}
+	done()
+	done()
+	if !r.Idle() {
+		t.Error("not idle once done")
+	}
+
+	// A timer value is work until it is received.
+	timer := r.NewTimer(time.Second)
+	if !r.Idle() {
+		t.Error("not idle while waiting for a timer")
+	}
+	r.Advance(time.Second)
+	if r.Idle() {
+		t.Error("idle while the timer value is not received")
+	}
+	<-timer.C
+	if !r.Idle() {
+		t.Error("not idle once the timer value is received")
+	}
+
+	// An AfterFunc function is on its own once started.
+	running, release := make(chan struct{}), make(chan struct{})
+	r.AfterFunc(time.Second, func() {
+		close(running)
+		<-release
+	})
+	r.Advance(time.Second)
+	<-running
+	if !r.Idle() {
+		t.Error("not idle while an AfterFunc function blocks")
+	}
+	close(release)
+}
+
+func TestIdleAbandoned(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, false })
+
+	// The values of After are left behind when another case of a select
+	// is taken.
+	for i := 0; i < 1000; i++ {
+		select {
+		case <-r.After(time.Second):
+			t.Fatal("After fired right away")
+		default:
+		}
+	}
+	r.Advance(2 * time.Second)
+	if !r.Idle() {
+		t.Error("not idle once the time moved on from the abandoned values")
+	}
+	r.sent.Lock()
+	n := len(r.sent.m)
+	r.sent.Unlock()
+	if n != 0 {
+		t.Errorf("%d channels still recorded", n)
+	}
+}
+
+func TestAutoAdvanceBusy(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, true })
+
+	done := r.Busy()
+	start := r.Now()
+	slept := make(chan struct{})
+	go func() {
+		r.Sleep(time.Hour)
+		close(slept)
+	}()
+	select {
+	case <-slept:
+		t.Fatal("time moved forward while busy")
+	case <-time.After(20 * time.Millisecond):
+	}
+	done()
+	<-slept
+	if d := r.Now().Sub(start); d != time.Hour {
+		t.Errorf("slept for %v, want 1h", d)
+	}
+}
+
+func TestQuiescenceStatus(t *testing.T) {
+	b := startFakeBroker(t, "timer-ids", "quiescence")
+
+	timers := make(chan *Timer)
+	go func() { timers <- NewTimer(time.Second) }()
+	b.exchangeUntil(0)
+	<-timers
+
+	status := func() status {
+		b.tr.toRequester <- []byte("ready")
+		_, st, err := decodeBatchStatus(<-b.tr.toBroker, b.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.tr.toRequester <- encodeNow(0)
+		<-b.tr.toBroker
+		return st
+	}
+	if st := status(); !st.Idle || st.NextWakeup != int64(time.Second) {
+		t.Errorf("got status %+v, want idle until 1s", st)
+	}
+	done := Busy()
+	if st := status(); st.Idle {
+		t.Errorf("got status %+v, want busy", st)
+	}
+	done()
+}
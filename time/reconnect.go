@@ -0,0 +1,140 @@
+package time
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The broker may go away in the middle of a simulation : its process
+// restarts, or the connection with it is cut. When an exchange fails that
+// way, the requester loop opens a new connection and waits for the broker
+// there, for up to Config.ReconnectTimeout. The requests and the
+// cancellations of the failed exchange are sent again, and so are the
+// registrations of the waiting timers, which a new broker does not know
+// about. The callers only see a delay.
+
+// Metrics describes the reconnections of a requester with its broker.
+type Metrics struct {
+	// Reconnections counts the times the broker was lost and found
+	// again, or replaced by a new one saying hello.
+	Reconnections uint64
+
+	// ReconnectAttempts counts the connections opened while looking for
+	// the broker, successful or not.
+	ReconnectAttempts uint64
+
+	// ResentRequests counts the time requests sent again after a
+	// reconnection.
+	ResentRequests uint64
+
+	// ResentTimers counts the timer registrations sent again after a
+	// reconnection.
+	ResentTimers uint64
+
+	// Downtime is the total time spent without a broker, by the wall
+	// clock.
+	Downtime time.Duration
+
+	// LastReconnect is when the last reconnection happened, by the wall
+	// clock. It is the zero time if there was none.
+	LastReconnect time.Time
+}
+
+// metrics holds the Metrics of a requester.
+type metrics struct {
+	sync.Mutex
+	m Metrics
+}
+
+// ReadMetrics returns the reconnection metrics of the default requester.
+func ReadMetrics() Metrics {
+	return defaultRequester.Metrics()
+}
+
+// Metrics returns the reconnection metrics of r.
+func (r *Requester) Metrics() Metrics {
+	r.metrics.Lock()
+	defer r.metrics.Unlock()
+	return r.metrics.m
+}
+
+// reconnection is the state of the loop while it looks for the broker.
+type reconnection struct {
+	// lostAt is when the broker was lost, the zero time if it was not.
+	lostAt time.Time
+	// requests is how many requests were pending when it was lost.
+	requests int
+	// timers counts the timer registrations sent again since.
+	timers int
+	// abort ends the connection in progress when the time is up.
+	abort *time.Timer
+}
+
+// reconnect reports whether the loop should connect again after err,
+// because the broker was lost less than c.ReconnectTimeout ago. It waits
+// a little before returning true, not to hammer the broker.
+func (l *loop) reconnect(c Config, err error) bool {
+	if c.ReconnectTimeout == 0 || !errors.Is(err, ErrBrokerUnavailable) {
+		return false
+	}
+	if l.lost.lostAt.IsZero() {
+		l.lost = reconnection{lostAt: time.Now(), requests: len(l.pending)}
+		c.handleError(err)
+		c.logf("Lost the broker, reconnecting")
+	} else if c.ReconnectTimeout > 0 && time.Since(l.lost.lostAt) >= c.ReconnectTimeout {
+		return false
+	}
+
+	l.mu.Lock()
+	l.closeTransport()
+	l.mu.Unlock()
+	select {
+	case <-time.After(retryInterval):
+	case <-l.stop:
+		// The next connection fails with ErrShutdown.
+	}
+	l.r.metrics.Lock()
+	l.r.metrics.m.ReconnectAttempts++
+	l.r.metrics.Unlock()
+	return true
+}
+
+// abortReconnect arranges for t to be closed once the loop has been
+// looking for the broker for c.ReconnectTimeout, which ends a connection
+// still waiting for it. It is called with each new connection, and called
+// off by reconnected.
+func (l *loop) abortReconnect(t Transport, c Config) {
+	if l.lost.abort != nil {
+		l.lost.abort.Stop()
+	}
+	if l.lost.lostAt.IsZero() || c.ReconnectTimeout <= 0 {
+		return
+	}
+	l.lost.abort = time.AfterFunc(time.Until(l.lost.lostAt.Add(c.ReconnectTimeout)), func() {
+		l.interrupt(t)
+	})
+}
+
+// reconnected records a reconnection with the broker, once an exchange
+// succeeded after losing it.
+func (l *loop) reconnected(c Config) {
+	if l.lost.abort != nil {
+		l.lost.abort.Stop()
+	}
+	down := time.Since(l.lost.lostAt)
+	l.r.recordReconnect(down, l.lost.requests, l.lost.timers)
+	c.logf("Reconnected to the broker after %v : %d requests and %d timers sent again", down, l.lost.requests, l.lost.timers)
+	l.lost = reconnection{}
+}
+
+// recordReconnect adds a reconnection to the metrics of r.
+func (r *Requester) recordReconnect(down time.Duration, requests, timers int) {
+	r.metrics.Lock()
+	defer r.metrics.Unlock()
+	r.metrics.m.Reconnections++
+	r.metrics.m.ResentRequests += uint64(requests)
+	r.metrics.m.ResentTimers += uint64(timers)
+	r.metrics.m.Downtime += down
+	r.metrics.m.LastReconnect = time.Now()
+}
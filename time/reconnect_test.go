@@ -0,0 +1,250 @@
+package time
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+	r, errs := testRequester(t, func(c *Config) { c.ReconnectTimeout = time.Minute })
+	b := startFakeBrokerFor(t, r, "timer-ids")
+
+	timers := make(chan *Timer)
+	go func() { timers <- r.NewTimer(time.Second) }()
+	registered := b.exchangeUntil(0)
+	timer := <-timers
+
+	// The broker goes away in the middle of an exchange.
+	got := make(chan int64)
+	go func() { got <- r.RequestTime(5) }()
+	b.takeRequest()
+	b.drop()
+	if err := <-errs; !errors.Is(err, ErrBrokerUnavailable) {
+		t.Errorf("the handler got %v, want the broker unavailable", err)
+	}
+
+	// A new broker knows neither about the timer nor about the request.
+	b.hello("timer-ids")
+	batch := b.exchangeUntil(42)
+	want := []timerEntry{
+		{ID: registered[0].ID, Kind: entryTimer, Duration: int64(time.Second)},
+		{ID: batch[1].ID, Kind: entryTimer, Duration: 5},
+	}
+	if !reflect.DeepEqual(batch, want) {
+		t.Fatalf("got batch %v, want %v", batch, want)
+	}
+	if now := <-got; now != 42 {
+		t.Errorf("got time %d, want 42", now)
+	}
+	b.exchange(int64(time.Second), registered[0].ID)
+	<-timer.C
+
+	m := r.Metrics()
+	if m.Reconnections != 1 || m.ReconnectAttempts != 1 || m.ResentRequests != 1 || m.ResentTimers != 1 {
+		t.Errorf("got metrics %+v, want a single reconnection resending a request and a timer", m)
+	}
+	if m.Downtime <= 0 || m.LastReconnect.IsZero() {
+		t.Errorf("got metrics %+v, want the downtime and the time of the reconnection", m)
+	}
+}
+
+func TestReconnectTimeout(t *testing.T) {
+	r, errs := testRequester(t, func(c *Config) { c.ReconnectTimeout = 300 * time.Millisecond })
+	b := startFakeBrokerFor(t, r)
+
+	got := make(chan error)
+	go func() {
+		_, err := r.RequestTimeErr(5)
+		got <- err
+	}()
+	b.takeRequest()
+	b.drop()
+
+	// The broker never comes back : the error policy applies.
+	start := time.Now()
+	if err := <-got; !errors.Is(err, ErrBrokerUnavailable) {
+		t.Errorf("got error %v, want the broker unavailable", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("gave up after %v, want about 300ms", d)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; !errors.Is(err, ErrBrokerUnavailable) {
+			t.Errorf("the handler got %v, want the broker unavailable", err)
+		}
+	}
+	if m := r.Metrics(); m.Reconnections != 0 || m.ReconnectAttempts == 0 {
+		t.Errorf("got metrics %+v, want attempts and no reconnection", m)
+	}
+}
+
+func TestReconnectDisabled(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.ReconnectTimeout = 0 })
+	b := startFakeBrokerFor(t, r)
+
+	got := make(chan error)
+	go func() {
+		_, err := r.RequestTimeErr(5)
+		got <- err
+	}()
+	b.takeRequest()
+	b.drop()
+	if err := <-got; !errors.Is(err, ErrBrokerUnavailable) {
+		t.Errorf("got error %v, want the broker unavailable", err)
+	}
+	if m := r.Metrics(); m.ReconnectAttempts != 0 {
+		t.Errorf("got metrics %+v, want no attempt", m)
+	}
+}
+
+func TestBrokerReplaced(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.ReconnectTimeout = time.Minute })
+	b := startFakeBrokerFor(t, r, "timer-ids")
+
+	timers := make(chan *Timer)
+	go func() { timers <- r.NewTimer(time.Second) }()
+	registered := b.exchangeUntil(0)
+	<-timers
+
+	// A new broker says hello on the same connection.
+	b.hello("timer-ids")
+	batch := b.exchange(int64(time.Millisecond))
+	want := []timerEntry{{ID: registered[0].ID, Kind: entryTimer, Duration: int64(time.Second)}}
+	if !reflect.DeepEqual(batch, want) {
+		t.Fatalf("got batch %v, want %v", batch, want)
+	}
+	if m := r.Metrics(); m.Reconnections != 1 || m.ResentTimers != 1 || m.ReconnectAttempts != 0 {
+		t.Errorf("got metrics %+v, want a reconnection resending a timer", m)
+	}
+}
+
+func TestReconnectRequeue(t *testing.T) {
+	r, errs := testRequester(t, func(c *Config) { c.ReconnectTimeout = time.Minute })
+	b := startFakeBrokerFor(t, r, "timer-ids", "cancel")
+
+	timers := make(chan *Timer)
+	go func() { timers <- r.NewTimer(time.Hour) }()
+	registered := b.exchangeUntil(0)
+	tickers := make(chan *Ticker)
+	go func() { tickers <- r.NewTicker(time.Second) }()
+	ticks := b.exchangeUntil(0)
+	<-tickers
+
+	// The cancellation of the timer and the next tick of the ticker go in
+	// an exchange which fails. The new broker gets them, and the tick only
+	// once, although the waiting timers are registered again.
+	b.exchange(int64(time.Second), ticks[0].ID)
+	(<-timers).Stop()
+	b.takeRequest()
+	b.drop()
+	<-errs
+
+	b.hello("timer-ids", "cancel")
+	batch := b.exchange(int64(time.Second))
+	if len(batch) != 2 {
+		t.Fatalf("got batch %v, want the cancellation and the next tick", batch)
+	}
+	if want := (timerEntry{ID: registered[0].ID, Kind: entryCancel}); batch[0] != want {
+		t.Errorf("got entry %v, want %v", batch[0], want)
+	}
+	if e := batch[1]; e.Kind != entryTimer || e.Duration != int64(time.Second) {
+		t.Errorf("got entry %v, want the next tick in %v", e, time.Second)
+	}
+}
+
+// zmtpBroker is a broker of the first version of the protocol, behind a
+// REQ socket, like the broker of batkube.
+type zmtpBroker struct {
+	t    *testing.T
+	conn *zmtpConn
+}
+
+// dialZmtpBroker connects a new broker to the requester listening on addr,
+// which may not be listening yet.
+func dialZmtpBroker(t *testing.T, addr string) *zmtpBroker {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			zc, err := newZmtpConn(conn, "REQ", "REP")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &zmtpBroker{t: t, conn: zc}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// request sends msg and returns the reply.
+func (b *zmtpBroker) request(msg []byte) []byte {
+	if err := b.conn.writeMessage([]byte{}, msg); err != nil {
+		b.t.Fatal(err)
+	}
+	frames, err := b.conn.readMessage()
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		b.t.Fatalf("got reply %q, want a single part", frames)
+	}
+	return frames[1]
+}
+
+// exchange goes through one exchange, answering now, and returns the batch
+// it got.
+func (b *zmtpBroker) exchange(now int64) []timerEntry {
+	timers, err := decodeBatch(b.request([]byte("ready")), legacySession)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	if ack := string(b.request(encodeNow(now))); ack != "done" {
+		b.t.Fatalf("got ack %q, want %q", ack, "done")
+	}
+	return timers
+}
+
+func TestZmtpBrokerReplaced(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	r, _ := testRequester(t, func(c *Config) { c.Endpoint = "tcp://" + addr })
+
+	timers := make(chan *Timer)
+	go func() { timers <- r.NewTimer(time.Hour) }()
+	b := dialZmtpBroker(t, addr)
+	var batch []timerEntry
+	for len(batch) == 0 {
+		batch = b.exchange(0)
+	}
+	<-timers
+
+	// The broker goes away between two exchanges, and a new one takes
+	// its place, which does not know about the timer.
+	b.conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Metrics().ReconnectAttempts == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the requester did not notice the broker went away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b = dialZmtpBroker(t, addr)
+	want := []timerEntry{{Kind: entryTimer, Duration: int64(time.Hour)}}
+	if got := b.exchange(0); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got batch %v, want %v", got, want)
+	}
+	b.exchange(0)
+	if m := r.Metrics(); m.Reconnections != 1 || m.ResentTimers != 1 {
+		t.Errorf("got metrics %+v, want a reconnection resending a timer", m)
+	}
+}
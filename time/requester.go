@@ -1,41 +1,333 @@
 package time
 
 import (
-	"encoding/binary"
-	"encoding/json"
+	"context"
 	"fmt"
 	"sync"
-
-	"github.com/google/uuid"
-	zmq "github.com/pebbe/zmq4"
+	"sync/atomic"
+	"time"
 )
 
 // This code centralises the requests that have to be redirected to
 // batkube.
 
+// A Requester asks a broker for the time, and runs the timers waiting for
+// it. Each Requester has its own connection with its broker, its own
+// timers and its own idea of the current time.
+//
+// The package level functions, like Now, Sleep or NewTimer, use a default
+// Requester, set up with Configure or from the environment. Others can be
+// created with NewRequester, to talk to several brokers from the same
+// process.
+type Requester struct {
+	// lastNow is the last time received from the broker. It comes first
+	// for the alignment of atomic operations.
+	lastNow int64
+
+	// blocked counts the callers waiting for the time, for the watchdog.
+	blocked int32
+
+	// work counts the work in flight, see Idle.
+	work int32
+
+	// config returns the settings of the requester, when the loop starts.
+	config func() Config
+
+	// lifecycle holds the running loop, if any.
+	lifecycle struct {
+		sync.Mutex
+		l *loop
+	}
+
+	// entries holds the timer entries to send to the broker in the next
+	// exchange, on top of the timers registered by the requests
+	// themselves : cancellations, and the next ticks of periodic timers.
+	entries struct {
+		sync.Mutex
+		l []timerEntry
+		// drop is set while the loop runs the timers without a broker,
+		// which would never take the entries.
+		drop bool
+	}
+
+	// timers holds the waiting timers, in a heap and under the identifier
+	// of their registration with the broker.
+	timers struct {
+		sync.Mutex
+		heap timerHeap
+		byID map[uint64]*runtimeTimer
+	}
+
+	// timerAdded is signaled when a timer is added to the heap, for the
+	// loops which run the timers on their own clock.
+	timerAdded chan struct{}
+
+	metrics metrics
+
+	// sent holds the timer channels which were sent a value, with the time
+	// it was sent at, until it is received.
+	sent struct {
+		sync.Mutex
+		m map[chan time.Time]int64
+		// kept is how many channels were left by the last pruning.
+		kept int
+	}
+
+	// cal holds the *calendar of the requester, set up when its loop
+	// starts.
+	cal atomic.Value
+}
+
+func newRequester(config func() Config) *Requester {
+	r := &Requester{
+		config:     config,
+		timerAdded: make(chan struct{}, 1),
+	}
+	r.timers.byID = make(map[uint64]*runtimeTimer)
+	return r
+}
+
+// NewRequester returns a Requester talking to the broker described by c.
+// Like the default one, it only contacts the broker when it is first asked
+// for the time.
+func NewRequester(c Config) (*Requester, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return newRequester(func() Config { return c }), nil
+}
+
+// defaultRequester is used by the package level functions.
+var defaultRequester = newRequester(loadConfig)
+
 type request struct {
 	duration int64
-	uuid     uuid.UUID
+	// advance asks the virtual clock to move forward by duration, instead
+	// of registering a timer.
+	advance bool
+	// id identifies the timer registered by the request, if duration > 0.
+	id uint64
+	// reply receives the time from the requester loop. It is buffered so
+	// that replying never blocks the loop.
+	reply chan int64
 }
 
-var req = make(chan *request)
+// requests recycles the requests, with their reply channel, once the
+// reply has been received : a request only lives for the time of one
+// exchange with the broker, and there is no need to allocate a new one
+// for every call to Now.
+var requests = sync.Pool{
+	New: func() interface{} {
+		return &request{reply: make(chan int64, 1)}
+	},
+}
 
-// res is a map[uuid](chan int64)
-//
-// The sync map and UUID system is here to sync requests with replies.
-// These uuid are not forwarded to the Broker.
+// loop is one run of the requester loop, from its start to its shutdown.
+type loop struct {
+	r   *Requester
+	req chan *request
+
+	// callers counts the callers of requestTime using the loop. It is
+	// only added to under the lifecycle lock of the requester, while the
+	// loop is not stopping.
+	callers  sync.WaitGroup
+	stopping bool
+
+	// mu guards t and closed. The loop may be shut down while it is still
+	// opening its transport.
+	mu     sync.Mutex
+	t      Transport
+	closed bool
+
+	// stop is closed along with the transport, to interrupt the loop
+	// when it is not waiting for the broker.
+	stop chan struct{}
+
+	// pending holds the requests of the exchange in progress. They are
+	// kept when the exchange fails, to be answered later.
+	pending []*request
+
+	// lost is set while the loop is looking for the broker.
+	lost reconnection
+
+	// wait is what the loop is waiting for, for the watchdog.
+	wait waitState
+
+	// err is why the loop ended. It is set before done is closed.
+	err error
+
+	// done is closed when the loop has ended.
+	done chan struct{}
+}
+
+// start returns the running loop, starting a new one if there is none,
+// and counts the caller in. The caller must call l.callers.Done once it is
+// done with the loop.
 //
-// Some other technique have been tested to try to avoid the cost of
-// hashing keys and storing channels for every single requests, but failed.
+// Callers arriving while a loop is being shut down wait for it to end and
+// start a new one.
+func (r *Requester) start() *loop {
+	for {
+		r.lifecycle.Lock()
+		l := r.lifecycle.l
+		if l == nil {
+			l = &loop{
+				r:    r,
+				req:  make(chan *request),
+				stop: make(chan struct{}),
+				done: make(chan struct{}),
+			}
+			r.lifecycle.l = l
+			go l.run()
+		}
+		if !l.stopping {
+			l.callers.Add(1)
+			r.lifecycle.Unlock()
+			return l
+		}
+		r.lifecycle.Unlock()
+		<-l.done
+	}
+}
+
+// Shutdown stops the requester loop and closes its connection with the
+// broker. It first waits for the callers waiting for the time to be
+// answered, which takes the broker to go on with the exchanges. If ctx
+// expires before that, the connection is closed anyway, the callers left
+// get ErrShutdown and Shutdown returns the context error.
 //
-// The uuid system is very secure because it syncs requests and replies one by one
-// without having to block any of the code to avoid sending to closed channels
-// and whatnot.
-var res = sync.Map{}
+// Later calls to Now, Sleep, etc. open a new connection with the broker.
+func Shutdown(ctx context.Context) error {
+	return defaultRequester.Shutdown(ctx)
+}
+
+// Shutdown stops the loop of r, like the package level Shutdown.
+func (r *Requester) Shutdown(ctx context.Context) error {
+	r.lifecycle.Lock()
+	l := r.lifecycle.l
+	if l == nil {
+		r.lifecycle.Unlock()
+		return nil
+	}
+	l.stopping = true
+	r.lifecycle.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		l.callers.Wait()
+		close(idle)
+	}()
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// Closing the transport interrupts the loop, waiting for the next
+	// exchange.
+	l.close()
+	<-l.done
+	return err
+}
 
-var responder *zmq.Socket
+// open opens the transport of the loop, unless it was shut down already.
+func (l *loop) open(c Config) (Transport, error) {
+	t, err := newTransport(c)
+	if err != nil {
+		return nil, brokerError("opening transport", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		t.Close()
+		return nil, ErrShutdown
+	}
+	l.t = t
+	return t, nil
+}
 
-var running bool
+// closeTransport closes the transport of the loop, if it is open.
+// l.mu must be held.
+func (l *loop) closeTransport() {
+	if l.t != nil {
+		if err := l.t.Close(); err != nil {
+			l.r.config().logf("Error while closing transport : %v", err)
+		}
+		l.t = nil
+	}
+}
+
+// close closes the transport of the loop for good, once.
+func (l *loop) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.stop)
+	l.closeTransport()
+}
+
+// isClosed reports whether the loop was shut down.
+func (l *loop) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// lastTimerID is the identifier of the last timer registered with the
+// broker. Each registration gets a new one, so that a cancellation can
+// never withdraw a later registration of the same timer.
+var lastTimerID uint64
+
+func newTimerID() uint64 {
+	return atomic.AddUint64(&lastTimerID, 1)
+}
+
+func (r *Requester) queueEntry(e timerEntry) {
+	r.entries.Lock()
+	if !r.entries.drop {
+		r.entries.l = append(r.entries.l, e)
+	}
+	r.entries.Unlock()
+}
+
+// dropEntries forgets about the queued timer entries, and about the ones
+// queued later as long as drop is set. A broker found again afterwards is
+// told about the waiting timers by registerTimers.
+func (r *Requester) dropEntries(drop bool) {
+	r.entries.Lock()
+	defer r.entries.Unlock()
+	r.entries.l = nil
+	r.entries.drop = drop
+}
+
+// cancelTimer withdraws the timer registered under id from the broker. It
+// does not wait for the next exchange.
+func (r *Requester) cancelTimer(id uint64) {
+	if id == 0 {
+		return
+	}
+	r.queueEntry(timerEntry{ID: id, Kind: entryCancel})
+}
+
+// takeEntries returns the queued timer entries and forgets about them.
+func (r *Requester) takeEntries() []timerEntry {
+	r.entries.Lock()
+	defer r.entries.Unlock()
+	l := r.entries.l
+	r.entries.l = nil
+	return l
+}
+
+// requeueEntries puts back the entries of a failed exchange, ahead of the
+// ones queued since.
+func (r *Requester) requeueEntries(l []timerEntry) {
+	r.entries.Lock()
+	defer r.entries.Unlock()
+	r.entries.l = append(l, r.entries.l...)
+}
 
 /*
 Returns the current time given by Batsim, in nanoseconds.
@@ -43,82 +335,224 @@ If d is > 0, it tells batkube the scheduler requested for a timer.
 If now is the current time, the timer is supposed to fire at
 now + d.
 This will send a CALL_ME_LATER event to Batsim with timestamp now + d.
+It panics if the time can't be obtained, see RequestTimeErr.
 */
 func RequestTime(d int64) int64 {
-	// Could it be that two tests happen at the exact same time thus
-	// calling run() twice?
-	// TODO secure run() call?
-	if !running {
-		go run()
+	return defaultRequester.RequestTime(d)
+}
+
+// RequestTimeErr is like RequestTime, but returns an error instead of
+// panicking when the time can't be obtained : ErrShutdown, or an error of
+// the requester loop when its error policy is OnErrorPanic.
+func RequestTimeErr(d int64) (int64, error) {
+	return defaultRequester.RequestTimeErr(d)
+}
+
+// RequestTime asks the broker of r for the time, like the package level
+// RequestTime.
+func (r *Requester) RequestTime(d int64) int64 {
+	now, err := r.RequestTimeErr(d)
+	if err != nil {
+		panic(err)
 	}
+	return now
+}
 
-	var m request
-	m.duration = d
-	m.uuid = uuid.New()
+// RequestTimeErr asks the broker of r for the time, like the package level
+// RequestTimeErr.
+func (r *Requester) RequestTimeErr(d int64) (int64, error) {
+	var id uint64
+	if d > 0 {
+		id = newTimerID()
+	}
+	return r.requestTime(d, id)
+}
 
-	_, ok := res.Load(m.uuid)
-	for ok {
-		// This would be very, very unlucky. Supposedly it will never ever happen.
-		fmt.Printf(fmt.Sprintf("Map entry already set for UUID %s. Generating a new one\n", m.uuid))
-		m.uuid = uuid.New()
-		_, ok = res.Load(m.uuid)
+// requestTime is RequestTimeErr for a timer which was given its identifier
+// beforehand.
+func (r *Requester) requestTime(d int64, id uint64) (int64, error) {
+	if t, ok := r.realNow(); ok {
+		return t.UnixNano(), nil
 	}
-	resChan := make(chan int64)
-	res.Store(m.uuid, resChan)
+	l := r.start()
+	defer l.callers.Done()
 
-	req <- &m
-	return <-resChan
+	atomic.AddInt32(&r.blocked, 1)
+	defer atomic.AddInt32(&r.blocked, -1)
+
+	m := requests.Get().(*request)
+	m.duration = d
+	m.id = id
+	m.advance = false
+	return l.roundTrip(m)
 }
 
-func run() {
-	// Only one of these can be running at a time
-	if running {
-		panic("Two run() calls have been made simualtenously")
+// roundTrip sends m to the loop and returns the time it replies.
+func (l *loop) roundTrip(m *request) (int64, error) {
+	select {
+	case l.req <- m:
+		select {
+		case now := <-m.reply:
+			requests.Put(m)
+			return now, nil
+		case <-l.done:
+			// The reply may have come in just before the loop ended.
+			select {
+			case now := <-m.reply:
+				requests.Put(m)
+				return now, nil
+			default:
+			}
+		}
+	case <-l.done:
 	}
-	running = true
+	return 0, l.err
+}
 
-	sockEndpoint := "tcp://127.0.0.1:27000"
-	fmt.Println("Creating new responder socket for time requests on", sockEndpoint)
-	responder, err := zmq.NewSocket(zmq.REP)
-	if err != nil {
-		panic(err)
+// retryInterval is how long the loop waits before opening a new
+// connection with the broker, when its error policy is OnErrorRetry.
+const retryInterval = 100 * time.Millisecond
+
+func (l *loop) run() {
+	defer func() {
+		l.close()
+		l.r.lifecycle.Lock()
+		if l.r.lifecycle.l == l {
+			l.r.lifecycle.l = nil
+		}
+		l.r.lifecycle.Unlock()
+		close(l.done)
+	}()
+
+	c := l.r.config()
+	l.r.cal.Store(newCalendar(c))
+	switch c.Mode {
+	case ModeScaled:
+		l.runClock(c, newLocalClock(c))
+		l.err = ErrShutdown
+		return
+	case ModeVirtual:
+		l.runVirtual(c)
+		l.err = ErrShutdown
+		return
 	}
-	if err = responder.Bind(sockEndpoint); err != nil {
-		panic(err)
+	c.logf("Creating new responder socket for time requests on %s (%s)", c.Endpoint, c.Role)
+	if c.WatchdogInterval > 0 {
+		go l.watch(c)
 	}
-	defer func() {
-		if err = responder.Close(); err != nil {
-			fmt.Println("Error while closing responder socket :", err)
+	for {
+		err := l.connect(c)
+		// Errors are expected once the transport was closed by Shutdown.
+		if l.isClosed() {
+			l.err = ErrShutdown
+			return
 		}
-		if err = zmq.Term(); err != nil {
-			panic(err)
+		if l.reconnect(c, err) {
+			continue
 		}
-	}()
+		c.handleError(err)
 
+		switch c.OnError {
+		case OnErrorWallClock:
+			l.runClock(c, wallClockFrom(atomic.LoadInt64(&l.r.lastNow)))
+			l.err = ErrShutdown
+			return
+		case OnErrorRetry:
+			l.mu.Lock()
+			l.closeTransport()
+			l.mu.Unlock()
+			select {
+			case <-time.After(retryInterval):
+			case <-l.stop:
+				l.err = ErrShutdown
+				return
+			}
+		default:
+			l.err = err
+			return
+		}
+	}
+}
+
+// connect opens a new transport and serves the exchanges with the broker
+// over it, until an exchange fails.
+func (l *loop) connect(c Config) error {
+	t, err := l.open(c)
+	if err != nil {
+		return err
+	}
+	l.abortReconnect(t, c)
+	return l.serve(t, c)
+}
+
+// serve runs the exchanges with the broker over t, answering the requests
+// coming from l.req, until an exchange fails.
+func (l *loop) serve(t Transport, c Config) error {
+	r := l.r
+	// Brokers which do not say hello speak the first version of the
+	// protocol.
+	s := legacySession
+	first := true
 	for {
 		// One solution to the sync problem with batkube.
 		// Batsim tells us when it's ready, so that we know when to
 		// consume messages from the req channel
-		readyBytes, _ := responder.RecvBytes(0)
+		var readyBytes []byte
+		err := l.await(t, phaseHandshake, c.HandshakeTimeout, func() (err error) {
+			readyBytes, err = t.RecvHandshake()
+			return err
+		})
+		if err != nil {
+			return brokerError("receiving handshake", err)
+		}
+
+		// The broker at the other end of a new connection, or saying hello,
+		// may not know about the waiting timers : they are registered
+		// again. A hello in the middle of a connection means the broker
+		// was replaced.
+		if first || isHello(readyBytes) {
+			n := r.registerTimers()
+			if !l.lost.lostAt.IsZero() {
+				l.lost.timers += n
+			} else if !first {
+				r.recordReconnect(0, 0, n)
+			}
+			first = false
+		}
+
+		// A hello opens a new session, which may happen at any time if
+		// the broker was replaced.
+		if isHello(readyBytes) {
+			var reply []byte
+			s, reply, err = negotiate(readyBytes, c.metadata())
+			if err != nil {
+				return protocolError("negotiating session", err)
+			}
+			err = l.await(t, phaseAck, c.AckTimeout, func() error {
+				return t.SendAck(reply)
+			})
+			if err != nil {
+				return brokerError("sending hello", err)
+			}
+			c.logf("Broker session opened : protocol version %d, features %v", s.version, s.features)
+			continue
+		}
 
 		ready := string(readyBytes)
 		if ready != "ready" {
-			panic(fmt.Sprintf("Failed handshake : Expected %s, got %s", "ready", ready))
+			return protocolError("receiving handshake", fmt.Errorf("expected %s, got %s", "ready", ready))
 		}
 
 		// Using a range implies having to close req, which can't be done
 		// in this situation.
 		// Instead we just consume every object that is currently in req.
+		// The requests of a failed exchange are still pending, and go
+		// first.
 		closeReq := false
-		requests := make([]*request, 0)
-		timerRequests := make([]int64, 0)
 		for !closeReq {
 			select {
-			case m := <-req:
-				requests = append(requests, m)
-				if m.duration > 0 {
-					timerRequests = append(timerRequests, m.duration)
-				}
+			case m := <-l.req:
+				l.pending = append(l.pending, m)
 			default:
 				//if len(requests) > 0 {
 				//	closeReq = true
@@ -126,40 +560,64 @@ func run() {
 				closeReq = true
 			}
 		}
+		// The broker only knows about the queued entries once it answers
+		// with the time : they go back to the queue if the exchange
+		// fails before. encodeBatch may drop some of timerRequests.
+		entries := r.takeEntries()
+		timerRequests := append([]timerEntry(nil), entries...)
+		fail := func(err error) error {
+			r.requeueEntries(entries)
+			return err
+		}
+		for _, m := range l.pending {
+			if m.duration > 0 {
+				timerRequests = append(timerRequests, timerEntry{ID: m.id, Kind: entryTimer, Duration: m.duration})
+			}
+		}
 		// Other requests between now and when we receive the time but
 		// we can't do much about them : nothing tells us wether the
 		// scheduler will send other requests once we have consumed all
 		// pending requests.
 
-		// Probably there is something more efficient than json for this.
-		msg, err := json.Marshal(timerRequests)
+		msg, err := encodeBatch(timerRequests, r.status(len(l.pending)), s)
 		if err != nil {
-			panic("Error marshaling message:" + err.Error())
+			return fail(protocolError("encoding batch", err))
 		}
-		_, err = responder.SendBytes(msg, 0)
+		// The broker has to answer the batch with the time.
+		var b []byte
+		op := "sending batch"
+		err = l.await(t, phaseReply, c.ReplyTimeout, func() error {
+			if err := t.SendBatch(msg); err != nil {
+				return err
+			}
+			op = "receiving time"
+			b, err = t.RecvTime()
+			return err
+		})
 		if err != nil {
-			panic("Error sending message: " + err.Error())
+			return fail(brokerError(op, err))
 		}
-
-		b, err := responder.RecvBytes(0)
+		now, fired, err := decodeTime(b, s)
 		if err != nil {
-			panic("Error receiving message:" + err.Error())
-		}
-		now := int64(binary.LittleEndian.Uint64(b))
-		// overflow
-		if now < 0 {
-			now = 1<<63 - 1 // math.MaxInt64
+			return fail(protocolError("decoding time", err))
 		}
+		r.runTimers(now, fired)
 
 		// Send the replies
-		for _, m := range requests {
-			resChan, ok := res.Load(m.uuid)
-			if !ok {
-				panic(fmt.Sprintf("Could not load channel %s from res map\n", m.uuid.String()[5:]))
-			}
-			resChan.(chan int64) <- now
+		for _, m := range l.pending {
+			m.reply <- now
 		}
+		// Reused from one exchange to the next.
+		l.pending = l.pending[:0]
 
-		_, err = responder.SendBytes([]byte("done"), 0)
+		err = l.await(t, phaseAck, c.AckTimeout, func() error {
+			return t.SendAck([]byte("done"))
+		})
+		if err != nil {
+			return brokerError("sending ack", err)
+		}
+		if !l.lost.lostAt.IsZero() {
+			l.reconnected(c)
+		}
 	}
 }
@@ -0,0 +1,254 @@
+package time
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRequester returns a requester with the default settings, changed by
+// set, whose errors are sent on the returned channel. Errors past the
+// buffer of the channel are dropped. The requester is shut down at the end
+// of the test.
+func testRequester(t testing.TB, set func(c *Config)) (*Requester, chan error) {
+	errs := make(chan error, 10)
+	c := DefaultConfig()
+	c.ErrorHandler = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	set(&c)
+	r := newRequester(func() Config { return c })
+	t.Cleanup(func() { r.Shutdown(context.Background()) })
+	return r, errs
+}
+
+func TestRequestTimeConcurrent(t *testing.T) {
+	b := startFakeBroker(t)
+	stop := b.run(1)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prev := RequestTime(0)
+			for j := 0; j < 10; j++ {
+				now := RequestTime(0)
+				if now < prev {
+					t.Errorf("time went back from %d to %d", prev, now)
+				}
+				prev = now
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStartOnce(t *testing.T) {
+	b := startFakeBroker(t)
+	// Shut down the loop started by startFakeBroker, to start over.
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&b.opens, 0)
+	stop := b.run(1)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			RequestTime(0)
+		}()
+	}
+	wg.Wait()
+	if opens := atomic.LoadInt32(&b.opens); opens != 1 {
+		t.Errorf("the transport was opened %d times, want 1", opens)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	b := startFakeBroker(t)
+
+	replies := make(chan int64)
+	go func() { replies <- RequestTime(5) }()
+	b.takeRequest()
+
+	shutdown := make(chan error)
+	go func() { shutdown <- Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the caller was answered", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	b.tr.toRequester <- encodeNow(42)
+	<-b.tr.toBroker
+	if now := <-replies; now != 42 {
+		t.Errorf("got time %d, want 42", now)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	defaultRequester.lifecycle.Lock()
+	defer defaultRequester.lifecycle.Unlock()
+	if defaultRequester.lifecycle.l != nil {
+		t.Error("the loop is still there after Shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	b := startFakeBroker(t)
+
+	errs := make(chan error)
+	go func() {
+		_, err := RequestTimeErr(5)
+		errs <- err
+	}()
+	b.takeRequest()
+	// The broker never answers.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-errs; err != ErrShutdown {
+		t.Errorf("the caller left got %v, want %v", err, ErrShutdown)
+	}
+}
+
+func TestShutdownRestart(t *testing.T) {
+	b := startFakeBroker(t)
+	stop := b.run(1)
+	RequestTime(0)
+	stop()
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next call opens a new transport.
+	stop = b.run(1)
+	defer stop()
+	RequestTime(0)
+	if opens := atomic.LoadInt32(&b.opens); opens != 2 {
+		t.Errorf("the transport was opened %d times, want 2", opens)
+	}
+}
+
+// serveInproc plays the broker on b, always at time now, until b is
+// closed.
+func serveInproc(b *InprocBroker, now int64) {
+	for {
+		if b.Send([]byte("ready")) != nil {
+			return
+		}
+		if _, err := b.Recv(); err != nil {
+			return
+		}
+		if b.Send(encodeNow(now)) != nil {
+			return
+		}
+		if _, err := b.Recv(); err != nil {
+			return
+		}
+	}
+}
+
+func TestRequesters(t *testing.T) {
+	// Two requesters, with brokers at different times.
+	nows := []int64{int64(time.Hour), int64(2 * time.Hour)}
+	var rs []*Requester
+	for i, now := range nows {
+		c := DefaultConfig()
+		c.Endpoint = fmt.Sprintf("inproc://test-requesters-%d", i)
+		b, err := DialInproc(c.Endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		go serveInproc(b, now)
+
+		r, err := NewRequester(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Shutdown(context.Background())
+		rs = append(rs, r)
+	}
+
+	for i, r := range rs {
+		if now := r.Now().UnixNano(); now != nows[i] {
+			t.Errorf("requester %d: got time %d, want %d", i, now, nows[i])
+		}
+	}
+
+	// The time of the second requester is past the timer of the first
+	// one, which must not fire.
+	timer := rs[0].NewTimer(30 * time.Minute)
+	rs[1].Now()
+	rs[0].Now()
+	select {
+	case <-timer.C:
+		t.Error("the timer fired on the time of another requester")
+	default:
+	}
+	if !timer.Stop() {
+		t.Error("the timer is not waiting anymore")
+	}
+}
+
+// answerRequests stands for the requester loop, replying to every request
+// at once, until the returned function is called. It leaves the broker out
+// of the benchmarks, to only measure the cost of routing the replies.
+func answerRequests() (stop func()) {
+	defaultRequester.Shutdown(context.Background())
+	l := &loop{
+		req:  make(chan *request),
+		done: make(chan struct{}),
+	}
+	defaultRequester.lifecycle.Lock()
+	defaultRequester.lifecycle.l = l
+	defaultRequester.lifecycle.Unlock()
+	go func() {
+		for {
+			select {
+			case m := <-l.req:
+				m.reply <- 42
+			case <-l.done:
+				return
+			}
+		}
+	}()
+	return func() {
+		defaultRequester.lifecycle.Lock()
+		defaultRequester.lifecycle.l = nil
+		defaultRequester.lifecycle.Unlock()
+		close(l.done)
+	}
+}
+
+func BenchmarkRequestTime(b *testing.B) {
+	defer answerRequests()()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		RequestTime(0)
+	}
+}
+
+func BenchmarkRequestTimeParallel(b *testing.B) {
+	defer answerRequests()()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			RequestTime(0)
+		}
+	})
+}
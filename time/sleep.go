@@ -4,23 +4,54 @@
 
 package time
 
-import "time"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Values for the timer status field.
+//
+// Like in package runtime, the status of a timer is only changed with
+// atomic operations, and the timerRunning and timerModifying statuses give
+// the goroutine which set them exclusive access to the timer. Other
+// goroutines wanting to change the status wait for them to end.
+//
+// Valid transitions :
+//   startTimer :
+//     timerNoStatus   -> timerWaiting
+//     timerNoStatus   -> timerRunning (the timer is due already)
+//   runTimers, when the timer is due :
+//     timerWaiting    -> timerRunning
+//     timerRunning    -> timerDeleted
+//     timerRunning    -> timerWaiting (periodic timers)
+//   stopTimer :
+//     timerWaiting    -> timerModifying -> timerDeleted
+//     timerNoStatus   -> do nothing
+//     timerDeleted    -> do nothing
+//     timerRunning    -> wait until status changes
+//     timerModifying  -> wait until status changes
+//   modTimer :
+//     timerWaiting    -> timerModifying -> timerWaiting or timerRunning
+//     timerNoStatus   -> timerModifying -> timerWaiting or timerRunning
+//     timerDeleted    -> timerModifying -> timerWaiting or timerRunning
+//     timerRunning    -> wait until status changes
+//     timerModifying  -> wait until status changes
 const (
 	// Timer has no status set yet.
 	timerNoStatus = iota
 
 	// Waiting for timer to fire.
-	// The timer is in some P's heap.
+	// The timer is in the timers heap, or being taken out of it by
+	// runTimers.
 	timerWaiting
 
 	// Running the timer function.
 	// A timer will only have this status briefly.
 	timerRunning
 
-	// The timer is deleted and should be removed.
-	// It should not be run, but it is still in some P's heap.
+	// The timer was stopped, or has run and is not periodic.
+	// It is not in the timers heap.
 	timerDeleted
 
 	// The timer is being modified.
@@ -28,6 +59,38 @@ const (
 	timerModifying
 )
 
+// timerCond is broadcast whenever a timer leaves the timerRunning or
+// timerModifying status.
+var timerCond = sync.NewCond(new(sync.Mutex))
+
+// setStatus sets the status of t, which must be held with timerRunning or
+// timerModifying, and wakes up the goroutines waiting for it.
+func setStatus(t *runtimeTimer, status uint32) {
+	atomic.StoreUint32(&t.status, status)
+	broadcastStatus()
+}
+
+// broadcastStatus wakes up the goroutines waiting for a timer status to
+// change.
+func broadcastStatus() {
+	timerCond.L.Lock()
+	timerCond.Broadcast()
+	timerCond.L.Unlock()
+}
+
+// waitStatus blocks as long as the status of t is status.
+func waitStatus(t *runtimeTimer, status uint32) {
+	timerCond.L.Lock()
+	for atomic.LoadUint32(&t.status) == status {
+		timerCond.Wait()
+	}
+	timerCond.L.Unlock()
+}
+
+func badTimer() {
+	panic("bad timer")
+}
+
 // Interface to timers implemented in package runtime.
 // Must be in sync with ../runtime/time.go:/^type timer
 // Note : has been modified for the custom time lib
@@ -38,96 +101,109 @@ type runtimeTimer struct {
 	arg         interface{}
 	currentTime *time.Time
 	status      uint32
+
+	// requester runs the timer.
+	requester *Requester
+
+	// id identifies the registration of the timer with the broker, 0 if
+	// it has none.
+	id uint64
+
+	// index is the position of the timer in the timers heap.
+	index int
 }
 
 // Sleep pauses the current goroutine for at least the duration d.
 // A negative or zero duration causes Sleep to return immediately.
 func Sleep(d time.Duration) {
-	<-NewTimer(d).C
+	defaultRequester.Sleep(d)
+}
+
+// Sleep pauses the current goroutine for at least the duration d, as told
+// by the broker of r.
+func (r *Requester) Sleep(d time.Duration) {
+	if r.real() {
+		time.Sleep(d)
+		return
+	}
+	<-r.NewTimer(d).C
 }
 
 // when is a helper function for setting the 'when' field of a runtimeTimer.
 // It returns what the time will be, in nanoseconds, Duration d in the future.
 // If d is negative, it is ignored. If the returned value would be less than
 // zero because of an overflow, MaxInt64 is returned.
-func when(d time.Duration) int64 {
+// The timer is registered with the broker, under the returned identifier,
+// unless d <= 0 in which case the identifier is 0.
+// The timer counts as work in flight until it is started by startTimer or
+// modTimer.
+func (r *Requester) when(d time.Duration) (int64, uint64) {
+	atomic.AddInt32(&r.work, 1)
 	if d < 0 {
-		return runtimeNano()
+		d = 0
+	}
+	var id uint64
+	if d > 0 {
+		id = newTimerID()
+	}
+	now, err := r.requestTime(int64(d), id)
+	if err != nil {
+		atomic.AddInt32(&r.work, -1)
+		panic(err)
 	}
-	t := RequestTime(int64(d)) + int64(d)
+	t := now + int64(d)
 	if t < 0 {
 		t = 1<<63 - 1 // math.MaxInt64
 	}
-	return t
+	return t, id
 }
 
 // maxWhen is the maximum value for timer's when field.
 const maxWhen = 1<<63 - 1
 
 func startTimer(t *runtimeTimer) {
-	if t.status != timerNoStatus {
+	if atomic.LoadUint32(&t.status) != timerNoStatus {
 		panic("startTimer called with initialized timer")
 	}
-	t.status = timerWaiting
-	go func() {
-		for {
-			currentTime := runtimeNano()
-			//fmt.Printf("when : %d, now: %d\n", t.when, currentTime)
-			switch t.status {
-			case timerWaiting:
-				//fmt.Println("timer waiting")
-				if currentTime >= t.when {
-					*t.currentTime = time.Unix(0, currentTime)
-					t.status = timerRunning
-				}
-			case timerRunning:
-				//fmt.Println("timer running")
-				t.f(t.arg)
-				t.status = timerDeleted
-				if t.period > 0 {
-					// TODO
-					// Does the ticker's when have to be
-					// (original when) modulo period?
-					// Note : It is the case if Batsim
-					// wakes this timer up at the right time
-					t.when = currentTime + t.period
-					t.status = timerWaiting
-				}
-			case timerDeleted:
-				//fmt.Println("timer deleted")
-				return
-			case timerModifying:
-				// wait it out.
-			default:
-				panic("bad timer")
-			}
-		}
-	}()
+	// Timers which are due already don't have to wait for the next
+	// exchange with the broker.
+	r := t.requester
+	defer atomic.AddInt32(&r.work, -1)
+	r.timers.Lock()
+	if now := atomic.LoadInt64(&r.lastNow); t.when <= now {
+		r.timers.Unlock()
+		atomic.StoreUint32(&t.status, timerRunning)
+		runTimer(t, now)
+		return
+	}
+	atomic.StoreUint32(&t.status, timerWaiting)
+	r.addTimer(t)
+	r.timers.Unlock()
 }
 
 // stopTimer stops a timer.
 // It reports whether t was stopped before being run.
 func stopTimer(t *runtimeTimer) bool {
+	r := t.requester
 	for {
-		switch t.status {
+		switch s := atomic.LoadUint32(&t.status); s {
 		case timerWaiting:
-			t.status = timerDeleted
-			return true
+			if atomic.CompareAndSwapUint32(&t.status, s, timerModifying) {
+				r.timers.Lock()
+				r.removeTimer(t)
+				r.timers.Unlock()
+				r.cancelTimer(t.id)
+				setStatus(t, timerDeleted)
+				return true
+			}
 		case timerNoStatus, timerDeleted:
 			return false
 		case timerRunning, timerModifying:
-			// Timer is being run or there is a simultaneous call to modTimer.
-			// We wait for those calls to end
-			//
-			// There used to be a for loop here to wait out while
-			// the timer is running or modifying, however, it
-			// seemed to loop so fast the code was stuck in it
-			// despite having other routines that could change the
-			// status.
-			// The loop wasn't removed, instead it was moved higher up to give
-			// the other routines a chance to take over the process.
+			// Timer is being run or there is a simultaneous call to
+			// stopTimer or modTimer : wait for them to end.
+			waitStatus(t, s)
 		default:
-			panic("bad timer")
+			badTimer()
 		}
 	}
 }
@@ -137,46 +213,61 @@ func stopTimer(t *runtimeTimer) bool {
 // This should be called instead of addtimer if the timer value has been,
 // or may have been, used previously.
 // Reports whether the timer was modified before it was run.
-func resetTimer(t *runtimeTimer, when int64) bool {
-	return modTimer(t, when, t.period, t.f, t.arg)
+// Only used for Timers, which are never periodic : t.period can't be read
+// here, as another goroutine may be modifying it.
+func resetTimer(t *runtimeTimer, when int64, id uint64) bool {
+	return modTimer(t, when, id, 0)
 }
 
-// modtimer modifies an existing timer.
+// modtimer modifies an existing timer. id is the identifier of its new
+// registration with the broker.
 // Reports whether the timer was modified before it was run.
-func modTimer(t *runtimeTimer, when int64, period int64, f func(interface{}), arg interface{}) bool {
-	//fmt.Println("mod timer")
+func modTimer(t *runtimeTimer, when int64, id uint64, period int64) bool {
 	if when < 0 {
 		when = maxWhen
 	}
 
+	r := t.requester
+	defer atomic.AddInt32(&r.work, -1)
 	var pending bool
-
-	var exit bool
-	for !exit {
-		switch t.status {
+loop:
+	for {
+		switch s := atomic.LoadUint32(&t.status); s {
 		case timerWaiting:
-			t.status = timerDeleted
-			pending = true
-			exit = true
+			if atomic.CompareAndSwapUint32(&t.status, s, timerModifying) {
+				r.cancelTimer(t.id)
+				pending = true
+				break loop
+			}
 		case timerNoStatus, timerDeleted:
-			pending = false
-			exit = true
+			if atomic.CompareAndSwapUint32(&t.status, s, timerModifying) {
+				break loop
+			}
 		case timerRunning, timerModifying:
 			// See stopTimer comment
+			waitStatus(t, s)
 		default:
-			panic("bad timer")
+			badTimer()
 		}
 	}
 
-	t.status = timerModifying
-
-	t.f = f
-	t.arg = arg
+	r.timers.Lock()
+	r.removeTimer(t)
 	t.when = when
+	t.id = id
 	t.period = period
-
-	t.status = timerNoStatus
-	startTimer(t)
+	if now := atomic.LoadInt64(&r.lastNow); when <= now {
+		r.timers.Unlock()
+		setStatus(t, timerRunning)
+		runTimer(t, now)
+		return pending
+	}
+	// The status must be set before runTimers can take the timer out of
+	// the heap.
+	r.addTimer(t)
+	atomic.StoreUint32(&t.status, timerWaiting)
+	r.timers.Unlock()
+	broadcastStatus()
 
 	return pending
 }
@@ -188,6 +279,10 @@ func modTimer(t *runtimeTimer, when int64, period int64, f func(interface{}), ar
 type Timer struct {
 	C <-chan time.Time
 	r runtimeTimer
+
+	// std is the timer of the standard package behind the Timer, in
+	// ModeReal.
+	std *time.Timer
 }
 
 // Stop prevents the Timer from firing.
@@ -213,6 +308,9 @@ type Timer struct {
 // If the caller needs to know whether f is completed, it must coordinate
 // with f explicitly.
 func (t *Timer) Stop() bool {
+	if t.std != nil {
+		return t.std.Stop()
+	}
 	if t.r.f == nil {
 		panic("time: Stop called on uninitialized Timer")
 	}
@@ -222,12 +320,24 @@ func (t *Timer) Stop() bool {
 // NewTimer creates a new Timer that will send
 // the current time on its channel after at least duration d.
 func NewTimer(d time.Duration) *Timer {
+	return defaultRequester.NewTimer(d)
+}
+
+// NewTimer creates a new Timer run by r.
+func (r *Requester) NewTimer(d time.Duration) *Timer {
+	if r.real() {
+		std := time.NewTimer(d)
+		return &Timer{C: std.C, std: std}
+	}
 	c := make(chan time.Time, 1)
+	w, id := r.when(d)
 	t := &Timer{
 		C: c,
 		r: runtimeTimer{
-			when: when(d),
-			f:    sendTime,
+			when:      w,
+			f:         sendTime,
+			requester: r,
+			id:        id,
 		},
 	}
 	t.r.currentTime = &time.Time{}
@@ -260,11 +370,14 @@ func NewTimer(d time.Duration) *Timer {
 // Reset should always be invoked on stopped or expired channels, as described above.
 // The return value exists to preserve compatibility with existing programs.
 func (t *Timer) Reset(d time.Duration) bool {
+	if t.std != nil {
+		return t.std.Reset(d)
+	}
 	if t.r.f == nil {
 		panic("time: Reset called on uninitialized Timer")
 	}
-	w := when(d)
-	return resetTimer(&t.r, w)
+	w, id := t.r.requester.when(d)
+	return resetTimer(&t.r, w, id)
 }
 
 type sendTimeArgs struct {
@@ -291,25 +404,39 @@ func sendTime(args interface{}) {
 // until the timer fires. If efficiency is a concern, use NewTimer
 // instead and call Timer.Stop if the timer is no longer needed.
 func After(d time.Duration) <-chan time.Time {
-	return NewTimer(d).C
+	return defaultRequester.After(d)
+}
+
+// After waits for the duration to elapse, as told by the broker of r, and
+// then sends the current time on the returned channel.
+func (r *Requester) After(d time.Duration) <-chan time.Time {
+	return r.NewTimer(d).C
 }
 
 // AfterFunc waits for the duration to elapse and then calls f
 // in its own goroutine. It returns a Timer that can
 // be used to cancel the call using its Stop method.
 func AfterFunc(d time.Duration, f func()) *Timer {
+	return defaultRequester.AfterFunc(d, f)
+}
+
+// AfterFunc waits for the duration to elapse, as told by the broker of r,
+// and then calls f in its own goroutine.
+func (r *Requester) AfterFunc(d time.Duration, f func()) *Timer {
+	if r.real() {
+		return &Timer{std: time.AfterFunc(d, f)}
+	}
+	w, id := r.when(d)
 	t := &Timer{
 		r: runtimeTimer{
-			when: when(d),
-			f:    goFunc,
-			arg:  f,
+			when:      w,
+			f:         r.goFunc,
+			arg:       f,
+			requester: r,
+			id:        id,
 		},
 	}
 	t.r.currentTime = &time.Time{}
 	startTimer(&t.r)
 	return t
 }
-
-func goFunc(arg interface{}) {
-	go arg.(func())()
-}
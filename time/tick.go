@@ -14,6 +14,10 @@ import (
 type Ticker struct {
 	C <-chan time.Time // The channel on which the ticks are delivered.
 	r runtimeTimer
+
+	// std is the ticker of the standard package behind the Ticker, in
+	// ModeReal.
+	std *time.Ticker
 }
 
 // NewTicker returns a new Ticker containing a channel that will send the
@@ -22,19 +26,31 @@ type Ticker struct {
 // The duration d must be greater than zero; if not, NewTicker will panic.
 // Stop the ticker to release associated resources.
 func NewTicker(d time.Duration) *Ticker {
+	return defaultRequester.NewTicker(d)
+}
+
+// NewTicker returns a new Ticker run by r.
+func (r *Requester) NewTicker(d time.Duration) *Ticker {
 	if d <= 0 {
 		panic(errors.New("non-positive interval for NewTicker"))
 	}
+	if r.real() {
+		std := time.NewTicker(d)
+		return &Ticker{C: std.C, std: std}
+	}
 	// Give the channel a 1-element time buffer.
 	// If the client falls behind while reading, we drop ticks
 	// on the floor until the client catches up.
 	c := make(chan time.Time, 1)
+	w, id := r.when(d)
 	t := &Ticker{
 		C: c,
 		r: runtimeTimer{
-			when:   when(d),
-			period: int64(d),
-			f:      sendTime,
+			when:      w,
+			period:    int64(d),
+			f:         sendTime,
+			requester: r,
+			id:        id,
 		},
 	}
 	t.r.currentTime = &time.Time{}
@@ -47,16 +63,25 @@ func NewTicker(d time.Duration) *Ticker {
 // Stop does not close the channel, to prevent a concurrent goroutine
 // reading from the channel from seeing an erroneous "tick".
 func (t *Ticker) Stop() {
+	if t.std != nil {
+		t.std.Stop()
+		return
+	}
 	stopTimer(&t.r)
 }
 
 // Reset stops a ticker and resets its period to the specified duration.
 // The next tick will arrive after the new period elapses.
 func (t *Ticker) Reset(d time.Duration) {
+	if t.std != nil {
+		resetStdTicker(t.std, d)
+		return
+	}
 	if t.r.f == nil {
 		panic("time: Reset called on uninitialized Ticker")
 	}
-	modTimer(&t.r, when(d), int64(d), t.r.f, t.r.arg)
+	w, id := t.r.requester.when(d)
+	modTimer(&t.r, w, id, int64(d))
 }
 
 // Tick is a convenience wrapper for NewTicker providing access to the ticking
@@ -65,8 +90,14 @@ func (t *Ticker) Reset(d time.Duration) {
 // Ticker cannot be recovered by the garbage collector; it "leaks".
 // Unlike NewTicker, Tick will return nil if d <= 0.
 func Tick(d time.Duration) <-chan time.Time {
+	return defaultRequester.Tick(d)
+}
+
+// Tick is like NewTicker, with a Ticker run by r, but only gives access to
+// the ticking channel.
+func (r *Requester) Tick(d time.Duration) <-chan time.Time {
 	if d <= 0 {
 		return nil
 	}
-	return NewTicker(d).C
+	return r.NewTicker(d).C
 }
@@ -0,0 +1,11 @@
+//go:build go1.15
+// +build go1.15
+
+package time
+
+import "time"
+
+// resetStdTicker resets a ticker of the standard package.
+func resetStdTicker(t *time.Ticker, d time.Duration) {
+	t.Reset(d)
+}
@@ -0,0 +1,12 @@
+//go:build !go1.15
+// +build !go1.15
+
+package time
+
+import "time"
+
+// resetStdTicker resets a ticker of the standard package, which can't be
+// done before Go 1.15 : Ticker.Reset does not exist there.
+func resetStdTicker(t *time.Ticker, d time.Duration) {
+	panic("time: Ticker.Reset needs Go 1.15 in ModeReal")
+}
@@ -1,8 +1,11 @@
 package time
 
 import (
+	"fmt"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestSimpleForloop(t *testing.T) {
@@ -41,3 +44,71 @@ func TestEpoch(t *testing.T) {
 	nanos := now.UnixNano()
 	t.Logf("now %v\nunix %d\nnanos %d\n", now, unix, nanos)
 }
+
+// The values of the package are the standard ones, so code written for
+// the standard package compiles unchanged.
+func TestStdTypes(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, false })
+	start := r.Now()
+	r.Advance(90 * time.Second)
+	var elapsed time.Duration = r.Now().Sub(start)
+	if elapsed != 90*Second {
+		t.Errorf("got %v elapsed, want %v", elapsed, 90*Second)
+	}
+
+	var d Duration = Since(Now())
+	if d < 0 {
+		t.Errorf("got %v since now", d)
+	}
+	if got := Unix(60, 0).Sub(time.Unix(0, 0)); got != Minute {
+		t.Errorf("got %v between Unix times, want %v", got, Minute)
+	}
+	if d, err := ParseDuration("1h30m"); err != nil || d != 90*time.Minute {
+		t.Errorf("got %v, %v, want %v", d, err, 90*time.Minute)
+	}
+	if _, err := Parse(RFC3339, "2020-01-01"); err == nil {
+		t.Error("parsed a date without a time as RFC3339")
+	} else if _, ok := err.(*time.ParseError); !ok {
+		t.Errorf("got error %T, want *time.ParseError", err)
+	}
+	date := Date(2020, March, 1, 0, 0, 0, 0, UTC)
+	if date.Weekday() != Sunday || !date.Equal(time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got date %v, a %v", date, date.Weekday())
+	}
+}
+
+func TestMonotonic(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, false })
+	r.Advance(time.Hour)
+	start := r.Now()
+	mono := r.RequestTime(0) - startNano
+	want := fmt.Sprintf(" m=+%d.%09d", mono/1e9, mono%1e9)
+	if s := start.String(); !strings.HasSuffix(s, want) {
+		t.Errorf("got %q, want a monotonic reading of %q", s, want)
+	}
+	if start == start.Round(0) || !start.Equal(start.Round(0)) {
+		t.Error("Round(0) did not strip the monotonic reading alone")
+	}
+
+	r.Advance(1500 * time.Millisecond)
+	end := r.Now()
+	if d := end.Sub(start); d != 1500*time.Millisecond {
+		t.Errorf("got %v elapsed, want %v", d, 1500*time.Millisecond)
+	}
+	if d := end.Sub(start.In(time.FixedZone("east", 3600))); d != 1500*time.Millisecond {
+		t.Errorf("got %v elapsed across zones, want %v", d, 1500*time.Millisecond)
+	}
+	if !start.Before(end) || !end.After(start) {
+		t.Error("start is not before end")
+	}
+
+	timer := r.NewTimer(time.Second)
+	r.Advance(time.Second)
+	fired := <-timer.C
+	if d := fired.Sub(end); d != time.Second {
+		t.Errorf("timer fired %v after end, want %v", d, time.Second)
+	}
+	if fired == fired.Round(0) {
+		t.Errorf("timer sent %v, without a monotonic reading", fired)
+	}
+}
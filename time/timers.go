@@ -0,0 +1,192 @@
+package time
+
+import (
+	"container/heap"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Timers are kept in a single heap, ordered by the time they fire. They
+// are run by the requester loop each time the broker sends the time, so
+// that waiting timers cost neither a goroutine nor requests to the broker.
+
+type timerHeap []*runtimeTimer
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].when < h[j].when }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*runtimeTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
+
+// addTimer adds t to the waiting timers. r.timers must be locked.
+// A timer already in the heap is left where it is : it would otherwise be
+// there twice, and removeTimer could only ever take out one of the copies.
+func (r *Requester) addTimer(t *runtimeTimer) {
+	if r.inHeap(t) {
+		return
+	}
+	heap.Push(&r.timers.heap, t)
+	if t.id != 0 {
+		r.timers.byID[t.id] = t
+	}
+	select {
+	case r.timerAdded <- struct{}{}:
+	default:
+	}
+}
+
+// untilNextTimer returns how long it is from now until the next timer is
+// due. It is an hour when there is no timer.
+func (r *Requester) untilNextTimer(now int64) time.Duration {
+	r.timers.Lock()
+	defer r.timers.Unlock()
+	if len(r.timers.heap) == 0 {
+		return time.Hour
+	}
+	if d := r.timers.heap[0].when - now; d > 0 {
+		return time.Duration(d)
+	}
+	return 0
+}
+
+// registerTimers queues the registrations of all the waiting timers with
+// the broker, for a broker which may not know about them, and returns how
+// many there are. They replace the registrations of the same timers still
+// in the queue, from a failed exchange.
+func (r *Requester) registerTimers() int {
+	now := atomic.LoadInt64(&r.lastNow)
+	r.timers.Lock()
+	defer r.timers.Unlock()
+	r.entries.Lock()
+	l := r.entries.l[:0]
+	for _, e := range r.entries.l {
+		if e.Kind != entryTimer || r.timers.byID[e.ID] == nil {
+			l = append(l, e)
+		}
+	}
+	r.entries.l = l
+	r.entries.Unlock()
+	for _, t := range r.timers.heap {
+		d := t.when - now
+		if d < 1 {
+			d = 1
+		}
+		r.queueEntry(timerEntry{ID: t.id, Kind: entryTimer, Duration: d})
+	}
+	return len(r.timers.heap)
+}
+
+// nextTimer returns when the next timer is due, and false if there is no
+// timer.
+func (r *Requester) nextTimer() (int64, bool) {
+	r.timers.Lock()
+	defer r.timers.Unlock()
+	if len(r.timers.heap) == 0 {
+		return 0, false
+	}
+	return r.timers.heap[0].when, true
+}
+
+// inHeap tells whether t is in the heap of the waiting timers. r.timers
+// must be locked.
+func (r *Requester) inHeap(t *runtimeTimer) bool {
+	return t.index >= 0 && t.index < len(r.timers.heap) && r.timers.heap[t.index] == t
+}
+
+// removeTimer removes t from the waiting timers, if it is there. r.timers
+// must be locked.
+func (r *Requester) removeTimer(t *runtimeTimer) {
+	if r.inHeap(t) {
+		heap.Remove(&r.timers.heap, t.index)
+	}
+	if r.timers.byID[t.id] == t {
+		delete(r.timers.byID, t.id)
+	}
+}
+
+// runTimers runs the timers the broker says have fired, and the ones which
+// should have fired by now. The latter covers brokers which don't report
+// fired timers.
+func (r *Requester) runTimers(now int64, fired []uint64) {
+	atomic.StoreInt64(&r.lastNow, now)
+
+	var due []*runtimeTimer
+	take := func(t *runtimeTimer) {
+		r.removeTimer(t)
+		// The status is only set to timerWaiting with r.timers locked,
+		// so a timer we get hold of here can't be modified before it
+		// runs. A timer being stopped or modified is left to the
+		// goroutine doing it, which puts it back in the heap if needed.
+		if atomic.CompareAndSwapUint32(&t.status, timerWaiting, timerRunning) {
+			due = append(due, t)
+		}
+	}
+	r.timers.Lock()
+	for _, id := range fired {
+		if t, ok := r.timers.byID[id]; ok {
+			take(t)
+		}
+	}
+	for len(r.timers.heap) > 0 && r.timers.heap[0].when <= now {
+		take(r.timers.heap[0])
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].when < due[j].when })
+	r.timers.Unlock()
+
+	for _, t := range due {
+		runTimer(t, now)
+	}
+}
+
+// runTimer runs the function of t, which must be held with timerRunning,
+// and sets it up again if it is periodic.
+func runTimer(t *runtimeTimer, now int64) {
+	*t.currentTime = t.requester.calendar().at(now)
+	t.f(t.arg)
+	if args, ok := t.arg.(sendTimeArgs); ok {
+		t.requester.noteSent(args.c, now)
+	}
+
+	if t.period <= 0 {
+		setStatus(t, timerDeleted)
+		return
+	}
+	// Skip the ticks we are late for, like package runtime does.
+	when := t.when + t.period
+	if now >= when {
+		when += t.period * (1 + (now-when)/t.period)
+	}
+	if when < 0 {
+		when = maxWhen
+	}
+	r := t.requester
+	id := newTimerID()
+	r.queueEntry(timerEntry{ID: id, Kind: entryTimer, Duration: when - now})
+	r.timers.Lock()
+	t.when = when
+	t.id = id
+	r.addTimer(t)
+	atomic.StoreUint32(&t.status, timerWaiting)
+	r.timers.Unlock()
+	broadcastStatus()
+}
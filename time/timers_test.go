@@ -0,0 +1,204 @@
+package time
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunTimers(t *testing.T) {
+	r := newRequester(DefaultConfig)
+	const base = 1000
+	goroutines := runtime.NumGoroutine()
+
+	const n = 100
+	var order []int
+	record := func(arg interface{}) { order = append(order, arg.(int)) }
+	for i := n; i > 0; i-- {
+		startTimer(&runtimeTimer{
+			when:        base + int64(i),
+			f:           record,
+			arg:         i,
+			currentTime: &time.Time{},
+			requester:   r,
+		})
+	}
+	if g := runtime.NumGoroutine(); g > goroutines {
+		t.Errorf("%d goroutines for %d waiting timers", g-goroutines, n)
+	}
+
+	r.runTimers(base+n/2, nil)
+	if len(order) != n/2 {
+		t.Fatalf("%d timers fired, want %d", len(order), n/2)
+	}
+	r.runTimers(base+n, nil)
+	for i, got := range order {
+		if got != i+1 {
+			t.Fatalf("timer %d fired in position %d", got, i+1)
+		}
+	}
+}
+
+func TestStartTimerSwept(t *testing.T) {
+	// A timer started while runTimers sweeps the heap must fire, even
+	// when the time moved past it after startTimer was called.
+	r := newRequester(DefaultConfig)
+	fired := make(chan bool, 1)
+	r.timers.Lock()
+	go startTimer(&runtimeTimer{
+		when:        1,
+		f:           func(interface{}) { fired <- true },
+		currentTime: &time.Time{},
+		requester:   r,
+	})
+	// Let startTimer block on the heap, then sweep it the way runTimers
+	// does, with nothing in it yet.
+	time.Sleep(10 * time.Millisecond)
+	atomic.StoreInt64(&r.lastNow, 1)
+	r.timers.Unlock()
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("timer started during a sweep did not fire")
+	}
+}
+
+func TestAfterFuncStopRace(t *testing.T) {
+	b := startFakeBroker(t, "timer-ids", "cancel")
+	stop := b.run(int64(time.Millisecond))
+	defer stop()
+
+	const n = 100
+	var fired, stopped int32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			timer := AfterFunc(time.Duration(i%10)*time.Millisecond, func() {
+				atomic.AddInt32(&fired, 1)
+			})
+			if timer.Stop() {
+				atomic.AddInt32(&stopped, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every timer either fired or was stopped, never both.
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&fired)+atomic.LoadInt32(&stopped) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers fired and %d were stopped, want %d in total", fired, stopped, n)
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestStopResetRace(t *testing.T) {
+	b := startFakeBroker(t, "timer-ids", "cancel")
+	stop := b.run(int64(time.Millisecond))
+	defer stop()
+
+	timer := NewTimer(time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				timer.Reset(time.Duration(j%3) * time.Millisecond)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				timer.Stop()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Whatever happened, the timer is in a sane state.
+	timer.Stop()
+	select {
+	case <-timer.C:
+	default:
+	}
+	timer.Reset(time.Millisecond)
+	<-timer.C
+	if timer.Stop() {
+		t.Error("Stop reported a timer which fired as active")
+	}
+}
+
+func TestTickerStopRace(t *testing.T) {
+	b := startFakeBroker(t, "timer-ids", "cancel")
+	stop := b.run(int64(time.Millisecond))
+	defer stop()
+
+	ticker := NewTicker(time.Millisecond)
+	for i := 0; i < 10; i++ {
+		<-ticker.C
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker.Stop()
+		close(done)
+	}()
+	ticker.Reset(2 * time.Millisecond)
+	<-done
+}
+
+func TestTickerResetRace(t *testing.T) {
+	// Resets only race with the loop running the timers when they run
+	// in parallel.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, false })
+
+	ticker := r.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	done := make(chan struct{})
+	var resets, wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		resets.Add(1)
+		go func() {
+			defer resets.Done()
+			for j := 0; j < 2000; j++ {
+				ticker.Reset(time.Duration(1+j%3) * time.Millisecond)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		resets.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			wg.Wait()
+			r.timers.Lock()
+			n := len(r.timers.heap)
+			r.timers.Unlock()
+			if n != 1 {
+				t.Fatalf("%d timers waiting, want the ticker only", n)
+			}
+			return
+		default:
+			r.Advance(time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package time
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Transport carries the exchanges between the requester and the broker.
+//
+// One exchange is made of four messages, always in the same order : the
+// broker says it is ready, the requester sends the batch of timer requests,
+// the broker replies with the current simulation time and the requester
+// acknowledges it. Sessions may also open with the broker saying hello,
+// which the requester acknowledges (see protocol.go). The transport only
+// moves raw messages around, encoding and decoding them is left to the
+// requester loop.
+type Transport interface {
+	// RecvHandshake blocks until the broker says it is ready to process
+	// time requests, and returns the message it sent.
+	RecvHandshake() ([]byte, error)
+
+	// SendBatch forwards the pending timer requests to the broker.
+	SendBatch(msg []byte) error
+
+	// RecvTime returns the current simulation time sent by the broker.
+	RecvTime() ([]byte, error)
+
+	// SendAck tells the broker all callers have been answered, which ends
+	// the exchange. It is also used to answer the broker hello.
+	SendAck(msg []byte) error
+
+	// Close releases the resources held by the transport. It may be
+	// called by another goroutine while a receive is blocked, which must
+	// then return an error.
+	Close() error
+}
+
+// transports lists the Transport implementations compiled in, by name.
+//
+// zmtp is a pure Go implementation of the ZeroMQ wire protocol and is
+// always available. zmq uses libzmq through cgo and is only built with the
+// libzmq build tag.
+var transports = map[string]func(c Config) (Transport, error){
+	"zmtp": newZmtpTransport,
+}
+
+// defaultTransport is used when the configuration does not name one.
+var defaultTransport = "zmtp"
+
+// newTransport opens the transport used by run with the given settings.
+// It is a variable so that the requester loop can be driven without a real
+// socket.
+var newTransport = openTransport
+
+// openTransport opens the transport named in c. inproc:// endpoints always
+// use the inproc transport, since no other one can reach a broker living in
+// the same binary.
+func openTransport(c Config) (Transport, error) {
+	if strings.HasPrefix(c.Endpoint, "inproc://") {
+		return newInprocTransport(c)
+	}
+	name := c.Transport
+	if name == "" {
+		name = defaultTransport
+	}
+	open, ok := transports[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %s (is it built in?)", name)
+	}
+	return open(c)
+}
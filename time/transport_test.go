@@ -0,0 +1,411 @@
+package time
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chanTransport is a Transport backed by channels. The test plays the role
+// of the broker on the other end.
+type chanTransport struct {
+	toRequester chan []byte
+	toBroker    chan []byte
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newChanTransport() *chanTransport {
+	return &chanTransport{
+		toRequester: make(chan []byte),
+		toBroker:    make(chan []byte),
+		closed:      make(chan struct{}),
+	}
+}
+
+// reopen returns a transport over the same channels, which is closed
+// independently.
+func (t *chanTransport) reopen() *chanTransport {
+	return &chanTransport{
+		toRequester: t.toRequester,
+		toBroker:    t.toBroker,
+		closed:      make(chan struct{}),
+	}
+}
+
+var errChanClosed = errors.New("chan transport closed")
+
+func (t *chanTransport) recv() ([]byte, error) {
+	select {
+	case msg := <-t.toRequester:
+		return msg, nil
+	case <-t.closed:
+		return nil, errChanClosed
+	}
+}
+
+func (t *chanTransport) send(msg []byte) error {
+	select {
+	case t.toBroker <- msg:
+		return nil
+	case <-t.closed:
+		return errChanClosed
+	}
+}
+
+func (t *chanTransport) RecvHandshake() ([]byte, error) { return t.recv() }
+func (t *chanTransport) SendBatch(msg []byte) error     { return t.send(msg) }
+func (t *chanTransport) RecvTime() ([]byte, error)      { return t.recv() }
+func (t *chanTransport) SendAck(msg []byte) error       { return t.send(msg) }
+
+func (t *chanTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+// encodeNow does what the broker does to send the time, and the timers
+// which fired.
+func encodeNow(now int64, fired ...uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(now))
+	if len(fired) == 0 {
+		return b
+	}
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(fired)))
+	for _, id := range fired {
+		b = append(b, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(b[len(b)-8:], id)
+	}
+	return b
+}
+
+// fakeBroker drives the requester loop from the broker end of a
+// chanTransport.
+type fakeBroker struct {
+	t  testing.TB
+	tr *chanTransport
+	s  session
+
+	// opens counts the transports opened by the requester loop. They all
+	// lead to the fake broker.
+	opens int32
+
+	// last is the transport opened last.
+	mu   sync.Mutex
+	last *chanTransport
+}
+
+// resetTimers starts over from time 0, without the timers of previous
+// tests nor the values they sent.
+func resetTimers() {
+	atomic.StoreInt64(&defaultRequester.lastNow, 0)
+	defaultRequester.timers.Lock()
+	defaultRequester.timers.heap = nil
+	defaultRequester.timers.byID = make(map[uint64]*runtimeTimer)
+	defaultRequester.timers.Unlock()
+	defaultRequester.takeEntries()
+	defaultRequester.sent.Lock()
+	defaultRequester.sent.m = nil
+	defaultRequester.sent.Unlock()
+}
+
+// simulated puts the default requester in ModeSimulated until the end of
+// the test, instead of the ModeVirtual of TestMain. Its running loop is
+// shut down first.
+func simulated(t testing.TB) {
+	if err := defaultRequester.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	config := defaultRequester.config
+	defaultRequester.config = DefaultConfig
+	t.Cleanup(func() { defaultRequester.config = config })
+}
+
+// startFakeBroker runs the requester loop against a fake broker, which
+// says hello with the given features if there are any. The loop is shut
+// down at the end of the test.
+func startFakeBroker(t testing.TB, features ...string) *fakeBroker {
+	simulated(t)
+	resetTimers()
+	return startFakeBrokerFor(t, defaultRequester, features...)
+}
+
+// startFakeBrokerFor is startFakeBroker for the loop of r.
+func startFakeBrokerFor(t testing.TB, r *Requester, features ...string) *fakeBroker {
+	b := &fakeBroker{t: t, tr: newChanTransport(), s: legacySession}
+	newTransport = func(Config) (Transport, error) {
+		atomic.AddInt32(&b.opens, 1)
+		tr := b.tr.reopen()
+		b.mu.Lock()
+		b.last = tr
+		b.mu.Unlock()
+		return tr, nil
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := r.Shutdown(ctx); err != nil {
+			t.Errorf("shutting down the requester: %v", err)
+		}
+		newTransport = openTransport
+	})
+	r.start().callers.Done()
+	if len(features) > 0 {
+		b.hello(features...)
+	}
+	return b
+}
+
+// hello opens a new session with the given features.
+func (b *fakeBroker) hello(features ...string) {
+	msg, _ := json.Marshal(hello{Version: protocolVersion, Features: features})
+	b.tr.toRequester <- msg
+	var h hello
+	if err := json.Unmarshal(<-b.tr.toBroker, &h); err != nil {
+		b.t.Fatal(err)
+	}
+	b.s = session{version: h.Version, features: parseFeatures(h.Features)}
+}
+
+// drop cuts the connection the requester loop opened last, as if the
+// broker went away.
+func (b *fakeBroker) drop() {
+	b.mu.Lock()
+	b.last.Close()
+	b.mu.Unlock()
+}
+
+// exchange goes through one exchange, answering now and the fired timers,
+// and returns the batch it got.
+func (b *fakeBroker) exchange(now int64, fired ...uint64) []timerEntry {
+	b.tr.toRequester <- []byte("ready")
+	timers, err := decodeBatch(<-b.tr.toBroker, b.s)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	b.tr.toRequester <- encodeNow(now, fired...)
+	if ack := string(<-b.tr.toBroker); ack != "done" {
+		b.t.Fatalf("got ack %q, want %q", ack, "done")
+	}
+	return timers
+}
+
+// run goes through exchanges in the background, moving time forward by step
+// each time, until the returned function is called.
+func (b *fakeBroker) run(step int64) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		now := atomic.LoadInt64(&defaultRequester.lastNow)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			now += step
+			b.tr.toRequester <- []byte("ready")
+			<-b.tr.toBroker
+			b.tr.toRequester <- encodeNow(now)
+			<-b.tr.toBroker
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// takeRequest goes through exchanges until the batch is not empty, and
+// stops in the middle of that one, before sending the time.
+func (b *fakeBroker) takeRequest() {
+	for {
+		b.tr.toRequester <- []byte("ready")
+		batch, err := decodeBatch(<-b.tr.toBroker, b.s)
+		if err != nil {
+			b.t.Fatal(err)
+		}
+		if len(batch) > 0 {
+			return
+		}
+		b.tr.toRequester <- encodeNow(0)
+		<-b.tr.toBroker
+	}
+}
+
+// exchangeUntil goes through exchanges at time now until the batch is not
+// empty, and returns it.
+func (b *fakeBroker) exchangeUntil(now int64) []timerEntry {
+	for {
+		if timers := b.exchange(now); len(timers) > 0 {
+			return timers
+		}
+	}
+}
+
+// serveOver runs the exchanges of a loop of the default requester over
+// tr, answering the requests coming from req.
+func serveOver(tr Transport, c Config, req chan *request) error {
+	l := &loop{r: defaultRequester, req: req}
+	return l.serve(tr, c)
+}
+
+func TestServeOverChanTransport(t *testing.T) {
+	resetTimers()
+	tr := newChanTransport()
+	defer tr.Close()
+	req := make(chan *request)
+	go serveOver(tr, DefaultConfig(), req)
+
+	m := &request{duration: 5, reply: make(chan int64, 1)}
+	go func() { req <- m }()
+
+	// The request may not be queued yet when the first exchanges happen,
+	// in which case they go through empty.
+	for {
+		tr.toRequester <- []byte("ready")
+		timers, err := decodeBatch(<-tr.toBroker, legacySession)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.toRequester <- encodeNow(42)
+		if len(timers) > 0 {
+			if len(timers) != 1 || timers[0].Duration != 5 {
+				t.Fatalf("got timer requests %v, want [5]", timers)
+			}
+			if now := <-m.reply; now != 42 {
+				t.Errorf("got time %d, want 42", now)
+			}
+		}
+		if ack := string(<-tr.toBroker); ack != "done" {
+			t.Fatalf("got ack %q, want %q", ack, "done")
+		}
+		if len(timers) > 0 {
+			return
+		}
+	}
+}
+
+func TestServeHello(t *testing.T) {
+	tr := newChanTransport()
+	c := DefaultConfig()
+	c.Metadata = map[string]string{"scheduler": "test"}
+	defer tr.Close()
+	go serveOver(tr, c, nil)
+
+	tr.toRequester <- []byte(`{"version":2,"features":["binary","metadata"]}`)
+	var h hello
+	if err := json.Unmarshal(<-tr.toBroker, &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 2 || len(h.Features) != 2 || h.Metadata["scheduler"] != "test" {
+		t.Fatalf("got hello %+v", h)
+	}
+
+	// Exchanges go on with the negotiated features
+	tr.toRequester <- []byte("ready")
+	if timers, err := decodeBatch(<-tr.toBroker, binarySession); err != nil || len(timers) != 0 {
+		t.Fatalf("got batch %v, %v, want an empty binary batch", timers, err)
+	}
+	tr.toRequester <- encodeNow(0)
+	if ack := string(<-tr.toBroker); ack != "done" {
+		t.Fatalf("got ack %q, want %q", ack, "done")
+	}
+}
+
+func TestServeCancel(t *testing.T) {
+	resetTimers()
+	tr := newChanTransport()
+	defer tr.Close()
+	go serveOver(tr, DefaultConfig(), nil)
+
+	tr.toRequester <- []byte(`{"version":2,"features":["timer-ids","cancel"]}`)
+	<-tr.toBroker
+
+	defaultRequester.cancelTimer(0) // not registered, nothing to withdraw
+	defaultRequester.cancelTimer(12)
+	tr.toRequester <- []byte("ready")
+	timers, err := decodeBatch(<-tr.toBroker, idsSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []timerEntry{{ID: 12, Kind: entryCancel}}; !reflect.DeepEqual(timers, want) {
+		t.Errorf("got batch %v, want %v", timers, want)
+	}
+	tr.toRequester <- encodeNow(0)
+	<-tr.toBroker
+}
+
+func TestTimerFiredByBroker(t *testing.T) {
+	b := startFakeBroker(t, "timer-ids")
+
+	timers := make(chan *Timer)
+	go func() { timers <- NewTimer(time.Second) }()
+	batch := b.exchangeUntil(0)
+	if len(batch) != 1 || batch[0].Kind != entryTimer || batch[0].Duration != int64(time.Second) {
+		t.Fatalf("got batch %v, want a single 1s timer", batch)
+	}
+	timer := <-timers
+
+	// Broker time may be off a little, what matters is that it says the
+	// timer fired.
+	b.exchange(int64(time.Second)-1, batch[0].ID)
+	if got := <-timer.C; got.UnixNano() != int64(time.Second)-1 {
+		t.Errorf("timer fired at %d, want %d", got.UnixNano(), int64(time.Second)-1)
+	}
+}
+
+func TestTimerFiredByTime(t *testing.T) {
+	b := startFakeBroker(t)
+
+	timers := make(chan *Timer)
+	go func() { timers <- NewTimer(time.Second) }()
+	b.exchangeUntil(0)
+	timer := <-timers
+
+	b.exchange(int64(time.Second) / 2)
+	select {
+	case <-timer.C:
+		t.Fatal("timer fired early")
+	default:
+	}
+	b.exchange(int64(time.Second))
+	<-timer.C
+}
+
+func TestTickerNextTick(t *testing.T) {
+	b := startFakeBroker(t, "timer-ids", "cancel")
+
+	tickers := make(chan *Ticker)
+	go func() { tickers <- NewTicker(time.Second) }()
+	batch := b.exchangeUntil(0)
+	ticker := <-tickers
+
+	// Late by half a period : the next tick is still due at 2s.
+	b.exchange(int64(1500*time.Millisecond), batch[0].ID)
+	<-ticker.C
+	batch = b.exchange(int64(1500 * time.Millisecond))
+	if len(batch) != 1 || batch[0].Kind != entryTimer || batch[0].Duration != int64(500*time.Millisecond) {
+		t.Fatalf("got batch %v, want the next tick in 500ms", batch)
+	}
+
+	ticker.Stop()
+	cancel := b.exchange(int64(1600 * time.Millisecond))
+	if want := []timerEntry{{ID: batch[0].ID, Kind: entryCancel}}; !reflect.DeepEqual(cancel, want) {
+		t.Fatalf("got batch %v, want %v", cancel, want)
+	}
+	b.exchange(int64(3 * time.Second))
+	select {
+	case <-ticker.C:
+		t.Fatal("stopped ticker ticked")
+	default:
+	}
+}
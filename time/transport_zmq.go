@@ -0,0 +1,156 @@
+// +build libzmq
+
+package time
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+func init() {
+	transports["zmq"] = newZmqTransport
+	defaultTransport = "zmq"
+}
+
+// zmqPollInterval bounds how long a receive keeps hold of the socket.
+// libzmq sockets can't be used by two threads at once, so a Close from
+// another goroutine has to wait for the receive to let go of it.
+const zmqPollInterval = 100 * time.Millisecond
+
+var (
+	errZmqClosed  = errors.New("zmq: transport closed")
+	errZmqTimeout = errors.New("zmq: receive timed out")
+)
+
+// zmqTransport speaks to the broker through a libzmq REP socket, in a
+// context of its own : terminating the default context would leave the
+// libzmq sockets of the rest of the process unusable.
+type zmqTransport struct {
+	// mu serializes the uses of the socket.
+	mu        sync.Mutex
+	ctx       *zmq.Context
+	responder *zmq.Socket
+	poller    *zmq.Poller
+	closed    bool
+
+	recvTimeout time.Duration
+}
+
+func newZmqTransport(c Config) (Transport, error) {
+	ctx, err := zmq.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	responder, err := ctx.NewSocket(zmq.REP)
+	if err != nil {
+		ctx.Term()
+		return nil, err
+	}
+	if err = setZmqOptions(responder, c); err == nil {
+		if c.Role == RoleConnect {
+			err = responder.Connect(c.Endpoint)
+		} else {
+			err = responder.Bind(c.Endpoint)
+		}
+	}
+	if err != nil {
+		responder.Close()
+		ctx.Term()
+		return nil, err
+	}
+	poller := zmq.NewPoller()
+	poller.Add(responder, zmq.POLLIN)
+	return &zmqTransport{
+		ctx:         ctx,
+		responder:   responder,
+		poller:      poller,
+		recvTimeout: c.RecvTimeout,
+	}, nil
+}
+
+func setZmqOptions(s *zmq.Socket, c Config) error {
+	linger := c.Linger
+	if linger < 0 {
+		linger = -1
+	}
+	if err := s.SetLinger(linger); err != nil {
+		return err
+	}
+	if err := s.SetSndhwm(c.HWM); err != nil {
+		return err
+	}
+	return s.SetRcvhwm(c.HWM)
+}
+
+// recv polls the socket until a message comes in, letting go of it at
+// every zmqPollInterval.
+func (t *zmqTransport) recv() ([]byte, error) {
+	var deadline time.Time
+	if t.recvTimeout > 0 {
+		deadline = time.Now().Add(t.recvTimeout)
+	}
+	for {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			return nil, errZmqClosed
+		}
+		polled, err := t.poller.Poll(zmqPollInterval)
+		if err == nil && len(polled) > 0 {
+			msg, err := t.responder.RecvBytes(0)
+			t.mu.Unlock()
+			return msg, err
+		}
+		t.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, errZmqTimeout
+		}
+	}
+}
+
+func (t *zmqTransport) send(msg []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return errZmqClosed
+	}
+	_, err := t.responder.SendBytes(msg, 0)
+	return err
+}
+
+func (t *zmqTransport) RecvHandshake() ([]byte, error) {
+	return t.recv()
+}
+
+func (t *zmqTransport) SendBatch(msg []byte) error {
+	return t.send(msg)
+}
+
+func (t *zmqTransport) RecvTime() ([]byte, error) {
+	return t.recv()
+}
+
+func (t *zmqTransport) SendAck(msg []byte) error {
+	return t.send(msg)
+}
+
+func (t *zmqTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	err := t.responder.Close()
+	// Terminating the context waits for the messages left to be sent, for
+	// as long as the linger period, which is for ever by default : it is
+	// not worth holding up the caller.
+	go t.ctx.Term()
+	return err
+}
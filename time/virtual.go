@@ -0,0 +1,114 @@
+package time
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// In ModeVirtual, the requester loop keeps the time itself, without a
+// broker or a socket. It only moves forward when told so with Advance, or
+// on its own with Config.AutoAdvance : once nothing asked for the time for
+// autoAdvanceDelay, and no work is in flight (see Busy), it jumps to the
+// next timer. Code built on the package can then be tested
+// deterministically, and without waiting.
+
+// autoAdvanceDelay is how long the virtual clock waits for the time to be
+// asked for, before moving on to the next timer.
+const autoAdvanceDelay = 5 * time.Millisecond
+
+// errNotVirtual is the panic of Advance outside of ModeVirtual.
+var errNotVirtual = errors.New("time: Advance needs ModeVirtual")
+
+// Advance moves the virtual clock of the default requester forward by d,
+// running the timers due on the way in order, each at the time it is due.
+// It panics unless the requester is in ModeVirtual.
+func Advance(d time.Duration) {
+	defaultRequester.Advance(d)
+}
+
+// Advance moves the virtual clock of r forward by d, like the package
+// level Advance.
+func (r *Requester) Advance(d time.Duration) {
+	if r.config().Mode != ModeVirtual {
+		panic(errNotVirtual)
+	}
+	if d < 0 {
+		d = 0
+	}
+	l := r.start()
+	defer l.callers.Done()
+
+	m := requests.Get().(*request)
+	m.duration = int64(d)
+	m.id = 0
+	m.advance = true
+	if _, err := l.roundTrip(m); err != nil {
+		panic(err)
+	}
+}
+
+// runVirtual answers the requests and runs the timers on a virtual clock,
+// until the loop is shut down.
+func (l *loop) runVirtual(c Config) {
+	r := l.r
+	now := atomic.LoadInt64(&r.lastNow)
+	c.logf("Running the timers on a virtual clock, from %v", time.Unix(0, now).UTC())
+	r.dropEntries(true)
+	defer r.dropEntries(false)
+	idle := time.NewTimer(0)
+	defer idle.Stop()
+	for {
+		r.runTimers(now, nil)
+
+		// Wait for a moment without requests before moving on to the next
+		// timer.
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		if _, ok := r.nextTimer(); ok && c.AutoAdvance {
+			idle.Reset(autoAdvanceDelay)
+		}
+		select {
+		case m := <-l.req:
+			if m.advance {
+				now = r.advanceTo(now, now+m.duration)
+			}
+			m.reply <- now
+		case <-r.timerAdded:
+		case <-idle.C:
+			if r.working() {
+				continue
+			}
+			if when, ok := r.nextTimer(); ok && when > now {
+				now = when
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// advanceTo moves time forward from now to then, running the timers due
+// on the way at the time they are due, and returns then.
+func (r *Requester) advanceTo(now, then int64) int64 {
+	if then < now {
+		// Overflow
+		then = maxWhen
+	}
+	for {
+		when, ok := r.nextTimer()
+		if !ok || when > then {
+			break
+		}
+		if when > now {
+			now = when
+		}
+		r.runTimers(now, nil)
+	}
+	r.runTimers(then, nil)
+	return then
+}
@@ -0,0 +1,111 @@
+package time
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The tests pasted from the standard library run on the virtual
+	// clock, unless BATSKY_MODE says otherwise to run them against a
+	// broker.
+	if os.Getenv("BATSKY_MODE") == "" {
+		c := DefaultConfig()
+		c.Mode = ModeVirtual
+		c.AutoAdvance = true
+		if err := Configure(c); err != nil {
+			panic(err)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+func TestAdvance(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, false })
+
+	start := r.Now()
+	timer := r.NewTimer(time.Second)
+	fired := make(chan time.Time, 3)
+	r.AfterFunc(2*time.Second, func() { fired <- r.Now() })
+
+	r.Advance(500 * time.Millisecond)
+	select {
+	case <-timer.C:
+		t.Fatal("timer fired early")
+	default:
+	}
+	if d := r.Now().Sub(start); d != 500*time.Millisecond {
+		t.Errorf("time moved by %v, want 500ms", d)
+	}
+
+	// Each timer fires at the time it is due, on the way.
+	r.Advance(10 * time.Second)
+	if got := <-timer.C; got.Sub(start) != time.Second {
+		t.Errorf("timer fired at %v, want 1s", got.Sub(start))
+	}
+	if d := r.Now().Sub(start); d != 10500*time.Millisecond {
+		t.Errorf("time moved by %v, want 10.5s", d)
+	}
+	<-fired
+}
+
+func TestAdvanceTicker(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, false })
+
+	start := r.Now()
+	ticker := r.NewTicker(time.Second)
+	defer ticker.Stop()
+	for i := 1; i <= 3; i++ {
+		r.Advance(time.Second)
+		if got := <-ticker.C; got.Sub(start) != time.Duration(i)*time.Second {
+			t.Errorf("tick %d at %v, want %ds", i, got.Sub(start), i)
+		}
+	}
+}
+
+func TestVirtualEntries(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, false })
+
+	// Without a broker, neither ticks nor stopped timers leave anything
+	// to send behind.
+	ticker := r.NewTicker(time.Second)
+	defer ticker.Stop()
+	for i := 0; i < 1000; i++ {
+		r.Advance(time.Second)
+		r.NewTimer(time.Hour).Stop()
+	}
+	r.entries.Lock()
+	n := len(r.entries.l)
+	r.entries.Unlock()
+	if n != 0 {
+		t.Errorf("%d timer entries queued", n)
+	}
+}
+
+func TestAutoAdvance(t *testing.T) {
+	r, _ := testRequester(t, func(c *Config) { c.Mode, c.AutoAdvance = ModeVirtual, true })
+
+	start := r.Now()
+	wall := time.Now()
+	r.Sleep(time.Hour)
+	if d := r.Now().Sub(start); d != time.Hour {
+		t.Errorf("slept for %v, want 1h", d)
+	}
+	if d := time.Since(wall); d > time.Second {
+		t.Errorf("sleeping took %v by the wall clock", d)
+	}
+}
+
+func TestAdvanceNotVirtual(t *testing.T) {
+	r, err := NewRequester(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() != errNotVirtual {
+			t.Error("Advance did not panic")
+		}
+	}()
+	r.Advance(time.Second)
+}
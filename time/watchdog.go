@@ -0,0 +1,139 @@
+package time
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Nothing tells the requester when the broker stops answering : the loop
+// just waits. Each phase of an exchange may be given a timeout, after which
+// the transport is closed and the exchange fails. The watchdog reports on
+// the loop when it has been waiting for too long, so that a stuck
+// simulation can at least be told apart from a slow one.
+
+// Phases of an exchange, as reported by the watchdog.
+const (
+	phaseHandshake = "handshake"
+	phaseReply     = "time reply"
+	phaseAck       = "ack"
+)
+
+// waitState is what the loop is waiting for.
+type waitState struct {
+	sync.Mutex
+	phase string
+	since time.Time
+}
+
+// await runs f, one phase of an exchange over t, closing t if it takes
+// longer than d. A d <= 0 means no timeout.
+func (l *loop) await(t Transport, phase string, d time.Duration, f func() error) error {
+	l.wait.Lock()
+	l.wait.phase = phase
+	l.wait.since = time.Now()
+	l.wait.Unlock()
+	defer func() {
+		l.wait.Lock()
+		l.wait.phase = ""
+		l.wait.Unlock()
+	}()
+
+	if d <= 0 {
+		return f()
+	}
+	var expired int32
+	timeout := time.AfterFunc(d, func() {
+		atomic.StoreInt32(&expired, 1)
+		l.interrupt(t)
+	})
+	err := f()
+	timeout.Stop()
+	if err != nil && atomic.LoadInt32(&expired) == 1 {
+		err = fmt.Errorf("%w : no %s after %v", ErrTimeout, phase, d)
+	}
+	return err
+}
+
+// interrupt closes t, if it is still the transport of the loop, which
+// makes the exchange in progress over it fail.
+func (l *loop) interrupt(t Transport) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.t == t {
+		l.closeTransport()
+	}
+}
+
+// waiting returns what the loop is waiting for and since how long, or an
+// empty phase if it is not waiting for the broker.
+func (l *loop) waiting() (string, time.Duration) {
+	l.wait.Lock()
+	defer l.wait.Unlock()
+	if l.wait.phase == "" {
+		return "", 0
+	}
+	return l.wait.phase, time.Since(l.wait.since)
+}
+
+// watch runs the watchdog of the loop, until the loop is shut down.
+func (l *loop) watch(c Config) {
+	tick := time.NewTicker(c.WatchdogInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-l.stop:
+			return
+		}
+		phase, waited := l.waiting()
+		if waited < c.WatchdogInterval {
+			continue
+		}
+		report := l.r.report(phase, waited)
+		c.logf("Watchdog : %s", report)
+		if c.WatchdogAbort {
+			panic("time: watchdog: " + report)
+		}
+	}
+}
+
+// maxReportedTimers is how many of the pending timers are listed by the
+// watchdog, the next ones to fire.
+const maxReportedTimers = 5
+
+// report describes the state of r for the watchdog, while its loop has
+// been waiting for phase.
+func (r *Requester) report(phase string, waited time.Duration) string {
+	now := atomic.LoadInt64(&r.lastNow)
+	r.timers.Lock()
+	pending := make([]struct {
+		id   uint64
+		when int64
+	}, len(r.timers.heap))
+	for i, t := range r.timers.heap {
+		pending[i].id, pending[i].when = t.id, t.when
+	}
+	r.timers.Unlock()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].when < pending[j].when })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "waiting for the broker %s for %v, %d callers blocked, %d timers pending",
+		phase, waited.Round(time.Millisecond), atomic.LoadInt32(&r.blocked), len(pending))
+	for i, t := range pending {
+		if i == maxReportedTimers {
+			b.WriteString(", ...")
+			break
+		}
+		if i == 0 {
+			b.WriteString(" : ")
+		} else {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "#%d in %v", t.id, time.Duration(t.when-now))
+	}
+	return b.String()
+}
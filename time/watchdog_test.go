@@ -0,0 +1,76 @@
+package time
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplyTimeout(t *testing.T) {
+	r, errs := testRequester(t, func(c *Config) { c.OnError = OnErrorPanic })
+	c := r.config()
+	c.ReconnectTimeout = 0
+	c.ReplyTimeout = 100 * time.Millisecond
+	r.config = func() Config { return c }
+	b := startFakeBrokerFor(t, r)
+
+	got := make(chan error)
+	go func() {
+		_, err := r.RequestTimeErr(5)
+		got <- err
+	}()
+	b.takeRequest()
+
+	// The broker never answers the batch.
+	err := <-got
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, ErrBrokerUnavailable) {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+	<-errs
+}
+
+// logLines is an io.Writer sending what is written to it on a channel.
+type logLines chan string
+
+func (w logLines) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+func TestWatchdog(t *testing.T) {
+	lines := make(logLines, 100)
+	r, _ := testRequester(t, func(c *Config) {
+		c.WatchdogInterval = 50 * time.Millisecond
+		c.Logger = log.New(lines, "", 0)
+	})
+	b := startFakeBrokerFor(t, r, "timer-ids")
+
+	timers := make(chan *Timer)
+	go func() { timers <- r.NewTimer(time.Second) }()
+	registered := b.exchangeUntil(0)
+	<-timers
+
+	// The broker stops going on with the exchanges while a caller waits.
+	answered := make(chan struct{})
+	go func() {
+		r.RequestTime(0)
+		close(answered)
+	}()
+	want := fmt.Sprintf(", 1 callers blocked, 1 timers pending : #%d in 1s\n", registered[0].ID)
+	for line := range lines {
+		if strings.HasPrefix(line, "Watchdog : waiting for the broker handshake for ") && strings.HasSuffix(line, want) {
+			break
+		}
+	}
+	for {
+		b.exchange(0)
+		select {
+		case <-answered:
+			return
+		default:
+		}
+	}
+}
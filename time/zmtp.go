@@ -0,0 +1,559 @@
+package time
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This is a minimal implementation of ZMTP 3.0, the wire protocol of
+// ZeroMQ (https://rfc.zeromq.org/spec/23/), written in pure Go. It only
+// covers what a REP socket talking to a single REQ peer needs : the NULL
+// security mechanism, single part messages and the REQ/REP envelope.
+//
+// This is enough for Batkube, which uses a regular libzmq REQ socket, to
+// talk to the requester without batsky-go depending on libzmq and cgo.
+
+// Frame flags
+const (
+	zmtpMore    = 0x01
+	zmtpLong    = 0x02
+	zmtpCommand = 0x04
+)
+
+// zmtpMaxFrame is the biggest frame we accept to read. Exchanges with the
+// broker are far smaller than that, anything bigger is garbage.
+const zmtpMaxFrame = 1 << 30
+
+// zmtpConn is a ZMTP connection with a peer, past the handshake.
+type zmtpConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// newZmtpConn runs the ZMTP greeting and handshake over conn, announcing
+// the socket type socketType. It fails if the peer's socket type is not
+// one of peerTypes.
+func newZmtpConn(conn net.Conn, socketType string, peerTypes ...string) (*zmtpConn, error) {
+	c := &zmtpConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+
+	// Greeting : signature, version, mechanism, as-server and filler.
+	// The whole greeting is sent at once, peers sending theirs in several
+	// steps to detect older versions will simply get it all.
+	var greeting [64]byte
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3
+	greeting[11] = 0
+	copy(greeting[12:32], "NULL")
+	if _, err := c.w.Write(greeting[:]); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c.r, greeting[:]); err != nil {
+		return nil, err
+	}
+	if greeting[0] != 0xff || greeting[9]&1 != 1 {
+		return nil, errors.New("zmtp: bad greeting signature")
+	}
+	if greeting[10] < 3 {
+		return nil, fmt.Errorf("zmtp: unsupported protocol version %d.%d", greeting[10], greeting[11])
+	}
+	if mechanism := string(bytes.TrimRight(greeting[12:32], "\x00")); mechanism != "NULL" {
+		return nil, fmt.Errorf("zmtp: unsupported security mechanism %s", mechanism)
+	}
+
+	// Handshake : with the NULL mechanism, both peers send a READY command
+	// holding their metadata.
+	ready := zmtpCommandBody("READY", map[string]string{"Socket-Type": socketType})
+	if err := c.writeFrame(zmtpCommand, ready); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	flags, body, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if flags&zmtpCommand == 0 {
+		return nil, errors.New("zmtp: expected READY command, got a message")
+	}
+	name, props, err := parseZmtpCommand(body)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "READY":
+	case "ERROR":
+		return nil, fmt.Errorf("zmtp: handshake refused by peer: %s", props["error"])
+	default:
+		return nil, fmt.Errorf("zmtp: expected READY command, got %s", name)
+	}
+	peerType := props["socket-type"]
+	for _, t := range peerTypes {
+		if peerType == t {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("zmtp: %s socket can't talk to a %s socket", socketType, peerType)
+}
+
+// zmtpCommandBody builds the body of a command frame.
+func zmtpCommandBody(name string, props map[string]string) []byte {
+	var b bytes.Buffer
+	b.WriteByte(byte(len(name)))
+	b.WriteString(name)
+	for k, v := range props {
+		b.WriteByte(byte(len(k)))
+		b.WriteString(k)
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(v)))
+		b.Write(size[:])
+		b.WriteString(v)
+	}
+	return b.Bytes()
+}
+
+// parseZmtpCommand splits a command frame body into the command name and
+// its properties. Property names are lowered since they are case
+// insensitive. Commands without properties (PING, PONG...) keep the rest
+// of their body under the "" key.
+func parseZmtpCommand(body []byte) (string, map[string]string, error) {
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return "", nil, errors.New("zmtp: malformed command")
+	}
+	name := string(body[1 : 1+body[0]])
+	body = body[1+body[0]:]
+	props := make(map[string]string)
+	if name != "READY" && name != "ERROR" {
+		props[""] = string(body)
+		return name, props, nil
+	}
+	if name == "ERROR" {
+		if len(body) < 1 || len(body) < 1+int(body[0]) {
+			return "", nil, errors.New("zmtp: malformed ERROR command")
+		}
+		props["error"] = string(body[1 : 1+body[0]])
+		return name, props, nil
+	}
+	for len(body) > 0 {
+		n := int(body[0])
+		if len(body) < 1+n+4 {
+			return "", nil, errors.New("zmtp: malformed property")
+		}
+		k := strings.ToLower(string(body[1 : 1+n]))
+		body = body[1+n:]
+		size := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		if uint32(len(body)) < size {
+			return "", nil, errors.New("zmtp: malformed property")
+		}
+		props[k] = string(body[:size])
+		body = body[size:]
+	}
+	return name, props, nil
+}
+
+func (c *zmtpConn) writeFrame(flags byte, body []byte) error {
+	var hdr [9]byte
+	hdr[0] = flags
+	n := 2
+	if len(body) > 255 {
+		hdr[0] |= zmtpLong
+		binary.BigEndian.PutUint64(hdr[1:], uint64(len(body)))
+		n = 9
+	} else {
+		hdr[1] = byte(len(body))
+	}
+	if _, err := c.w.Write(hdr[:n]); err != nil {
+		return err
+	}
+	_, err := c.w.Write(body)
+	return err
+}
+
+func (c *zmtpConn) readFrame() (byte, []byte, error) {
+	flags, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var size uint64
+	if flags&zmtpLong != 0 {
+		var b [8]byte
+		if _, err = io.ReadFull(c.r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	} else {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(b)
+	}
+	if size > zmtpMaxFrame {
+		return 0, nil, fmt.Errorf("zmtp: frame too big (%d bytes)", size)
+	}
+	body := make([]byte, size)
+	if _, err = io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+// readMessage returns the frames of the next message. Commands received in
+// between are handled on the fly.
+func (c *zmtpConn) readMessage() ([][]byte, error) {
+	var frames [][]byte
+	for {
+		flags, body, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&zmtpCommand != 0 {
+			if err = c.handleCommand(body); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		frames = append(frames, body)
+		if flags&zmtpMore == 0 {
+			return frames, nil
+		}
+	}
+}
+
+func (c *zmtpConn) handleCommand(body []byte) error {
+	name, props, err := parseZmtpCommand(body)
+	if err != nil {
+		return err
+	}
+	switch name {
+	case "PING":
+		// ZMTP 3.1 heartbeat : the PONG carries the ping context, which
+		// follows the 2 bytes TTL.
+		context := props[""]
+		if len(context) >= 2 {
+			context = context[2:]
+		} else {
+			context = ""
+		}
+		pong := append([]byte{4}, "PONG"...)
+		pong = append(pong, context...)
+		if err = c.writeFrame(zmtpCommand, pong); err != nil {
+			return err
+		}
+		return c.w.Flush()
+	case "ERROR":
+		return fmt.Errorf("zmtp: error from peer: %s", props["error"])
+	}
+	// Other commands are of no interest to us.
+	return nil
+}
+
+func (c *zmtpConn) writeMessage(frames ...[]byte) error {
+	for i, f := range frames {
+		var flags byte
+		if i < len(frames)-1 {
+			flags = zmtpMore
+		}
+		if err := c.writeFrame(flags, f); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+func (c *zmtpConn) Close() error {
+	return c.conn.Close()
+}
+
+// zmtpReconnectInterval is how long to wait before dialing the broker
+// again, like ZMQ_RECONNECT_IVL.
+const zmtpReconnectInterval = 100 * time.Millisecond
+
+// zmtpTransport is a pure Go REP socket. Messages are written as soon as
+// they are sent and never queued, so there is no high water mark to speak
+// of.
+type zmtpTransport struct {
+	network string
+	addr    string
+
+	// ln is nil when the transport connects to the broker.
+	ln net.Listener
+
+	// mu guards conn, greeting and closed against a Close from another
+	// goroutine.
+	mu     sync.Mutex
+	conn   *zmtpConn
+	closed bool
+
+	// greeting is the new connection going through the greeting, which
+	// Close has to interrupt too.
+	greeting net.Conn
+
+	linger      time.Duration
+	recvTimeout time.Duration
+
+	// logf logs like the requester loop.
+	logf func(format string, args ...interface{})
+
+	// envelope holds the routing frames of the request being answered,
+	// which must be sent back in front of the reply.
+	envelope [][]byte
+}
+
+// splitZmtpEndpoint turns a zmq endpoint into a network and an address
+// for package net.
+func splitZmtpEndpoint(endpoint string) (string, string, error) {
+	i := strings.Index(endpoint, "://")
+	if i < 0 {
+		return "", "", fmt.Errorf("zmtp: malformed endpoint %s", endpoint)
+	}
+	scheme, addr := endpoint[:i], endpoint[i+3:]
+	switch scheme {
+	case "tcp":
+		// zmq uses * as a wildcard for every interface
+		if strings.HasPrefix(addr, "*:") {
+			addr = addr[1:]
+		}
+		return "tcp", addr, nil
+	case "ipc":
+		return "unix", addr, nil
+	}
+	return "", "", fmt.Errorf("zmtp: unsupported transport %s", scheme)
+}
+
+func newZmtpTransport(c Config) (Transport, error) {
+	network, addr, err := splitZmtpEndpoint(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	t := &zmtpTransport{
+		network:     network,
+		addr:        addr,
+		linger:      c.Linger,
+		recvTimeout: c.RecvTimeout,
+		logf:        c.logf,
+	}
+	if c.Role == RoleBind {
+		if network == "unix" {
+			// Like zmq, take over the socket file left by a
+			// previous run.
+			os.Remove(addr)
+		}
+		if t.ln, err = net.Listen(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// deadline returns the deadline of a receive starting now.
+func (t *zmtpTransport) deadline() time.Time {
+	if t.recvTimeout > 0 {
+		return time.Now().Add(t.recvTimeout)
+	}
+	return time.Time{}
+}
+
+// dial returns a new connection with the broker, accepting or dialing it
+// depending on the role of the transport.
+func (t *zmtpTransport) dial() (net.Conn, error) {
+	deadline := t.deadline()
+	if t.ln != nil {
+		if l, ok := t.ln.(interface{ SetDeadline(time.Time) error }); ok {
+			if err := l.SetDeadline(deadline); err != nil {
+				return nil, err
+			}
+		}
+		return t.ln.Accept()
+	}
+	for {
+		conn, err := net.Dial(t.network, t.addr)
+		if err == nil {
+			return conn, nil
+		}
+		if t.isClosed() {
+			return nil, errZmtpClosed
+		}
+		// The broker may not be up yet : try again later, like zmq does.
+		if !deadline.IsZero() && time.Now().Add(zmtpReconnectInterval).After(deadline) {
+			return nil, err
+		}
+		time.Sleep(zmtpReconnectInterval)
+	}
+}
+
+// recv returns the body of the next request and keeps its envelope aside.
+func (t *zmtpTransport) recv() ([]byte, error) {
+	if err := t.conn.conn.SetReadDeadline(t.deadline()); err != nil {
+		return nil, err
+	}
+	frames, err := t.conn.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	// The envelope ends with the first empty frame.
+	i := 0
+	for i < len(frames) && len(frames[i]) > 0 {
+		i++
+	}
+	if i == len(frames) {
+		return nil, errors.New("zmtp: request without envelope delimiter")
+	}
+	t.envelope = frames[:i+1]
+	body := frames[i+1:]
+	if len(body) != 1 {
+		return nil, fmt.Errorf("zmtp: expected a single part message, got %d parts", len(body))
+	}
+	return body[0], nil
+}
+
+func (t *zmtpTransport) send(msg []byte) error {
+	if t.envelope == nil {
+		return errors.New("zmtp: no request to reply to")
+	}
+	frames := append(t.envelope, msg)
+	t.envelope = nil
+	return t.conn.writeMessage(frames...)
+}
+
+// RecvHandshake accepts or dials the broker if there is no connection with
+// it yet. When the broker goes away between two exchanges, the connection
+// is dropped and errZmtpPeerGone returned : the broker at the other end of
+// the next connection may be a new one, which the requester loop has to
+// tell about the waiting timers.
+func (t *zmtpTransport) RecvHandshake() ([]byte, error) {
+	for t.conn == nil {
+		conn, err := t.dial()
+		if err != nil {
+			return nil, err
+		}
+		zc, err := t.greet(conn)
+		if err != nil {
+			conn.Close()
+			if t.isClosed() {
+				return nil, errZmtpClosed
+			}
+			t.logf("Rejected broker connection : %v", err)
+			continue
+		}
+		if !t.setConn(zc) {
+			zc.Close()
+			return nil, errZmtpClosed
+		}
+	}
+	msg, err := t.recv()
+	if err == io.EOF {
+		t.conn.Close()
+		t.setConn(nil)
+		return nil, errZmtpPeerGone
+	}
+	return msg, err
+}
+
+// greet runs the greeting over conn, within the receive timeout : a peer
+// which connects and then says nothing must not hold up the transport.
+func (t *zmtpTransport) greet(conn net.Conn) (*zmtpConn, error) {
+	if !t.setGreeting(conn) {
+		return nil, errZmtpClosed
+	}
+	defer t.setGreeting(nil)
+	if err := conn.SetDeadline(t.deadline()); err != nil {
+		return nil, err
+	}
+	zc, err := newZmtpConn(conn, "REP", "REQ", "DEALER")
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return zc, nil
+}
+
+var (
+	errZmtpClosed   = errors.New("zmtp: transport closed")
+	errZmtpPeerGone = errors.New("zmtp: broker disconnected")
+)
+
+func (t *zmtpTransport) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// setGreeting records the connection going through the greeting, unless
+// the transport was closed in the meantime.
+func (t *zmtpTransport) setGreeting(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.greeting = conn
+	return true
+}
+
+// setConn replaces the connection with the broker, unless the transport
+// was closed in the meantime.
+func (t *zmtpTransport) setConn(conn *zmtpConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conn = conn
+	return true
+}
+
+func (t *zmtpTransport) SendBatch(msg []byte) error {
+	return t.send(msg)
+}
+
+func (t *zmtpTransport) RecvTime() ([]byte, error) {
+	return t.recv()
+}
+
+func (t *zmtpTransport) SendAck(msg []byte) error {
+	return t.send(msg)
+}
+
+func (t *zmtpTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if t.conn != nil {
+		if c, ok := t.conn.conn.(*net.TCPConn); ok && t.linger >= 0 {
+			c.SetLinger(int(t.linger / time.Second))
+		}
+		t.conn.Close()
+	}
+	if t.greeting != nil {
+		t.greeting.Close()
+	}
+	if t.ln != nil {
+		return t.ln.Close()
+	}
+	return nil
+}
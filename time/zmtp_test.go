@@ -0,0 +1,313 @@
+package time
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenZmtp(t *testing.T) (*zmtpTransport, string) {
+	tr, err := newZmtpTransport(Config{Endpoint: "tcp://127.0.0.1:0", Role: RoleBind})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt := tr.(*zmtpTransport)
+	return zt, zt.ln.Addr().String()
+}
+
+func TestZmtpRequestReply(t *testing.T) {
+	tr, addr := listenZmtp(t)
+	defer tr.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req, err := newZmtpConn(conn, "REQ", "REP")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer req.Close()
+		for _, msg := range []string{"ready", "now"} {
+			if err = req.writeMessage([]byte{}, []byte(msg)); err != nil {
+				t.Error(err)
+				return
+			}
+			frames, err := req.readMessage()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(frames) != 2 || len(frames[0]) != 0 || string(frames[1]) != msg+" reply" {
+				t.Errorf("got reply %q to %s", frames, msg)
+			}
+		}
+	}()
+
+	msg, err := tr.RecvHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "ready" {
+		t.Fatalf("got handshake %q, want %q", msg, "ready")
+	}
+	if err = tr.SendBatch([]byte("ready reply")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = tr.RecvTime(); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "now" {
+		t.Fatalf("got time %q, want %q", msg, "now")
+	}
+	if err = tr.SendAck([]byte("now reply")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestZmtpWire checks the transport against the bytes a libzmq REQ socket
+// puts on the wire.
+func TestZmtpWire(t *testing.T) {
+	tr, addr := listenZmtp(t)
+	defer tr.Close()
+
+	done := make(chan []byte)
+	go func() {
+		msg, err := tr.RecvHandshake()
+		if err != nil {
+			t.Error(err)
+		}
+		if err = tr.SendBatch([]byte("[]")); err != nil {
+			t.Error(err)
+		}
+		done <- msg
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	greeting := make([]byte, 64)
+	greeting[0], greeting[9], greeting[10], greeting[11] = 0xff, 0x7f, 3, 1
+	copy(greeting[12:], "NULL")
+	ready := []byte("\x04\x26\x05READY\x0bSocket-Type\x00\x00\x00\x03REQ\x08Identity\x00\x00\x00\x00")
+	request := []byte("\x01\x00\x00\x05ready")
+	if _, err = conn.Write(append(append(greeting, ready...), request...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := <-done; string(msg) != "ready" {
+		t.Fatalf("got handshake %q, want %q", msg, "ready")
+	}
+
+	b := make([]byte, 64)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0xff || b[9] != 0x7f || b[10] != 3 || string(b[12:16]) != "NULL" {
+		t.Fatalf("bad greeting % x", b)
+	}
+	want := []byte("\x04\x19\x05READY\x0bSocket-Type\x00\x00\x00\x03REP\x01\x00\x00\x02[]")
+	b = make([]byte, len(want))
+	if _, err = io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("got\n% x\nwant\n% x", b, want)
+	}
+}
+
+func TestZmtpConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tr, err := newZmtpTransport(Config{Endpoint: "tcp://" + ln.Addr().String(), Role: RoleConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req, err := newZmtpConn(conn, "REQ", "REP")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer req.Close()
+		if err = req.writeMessage([]byte{}, []byte("ready")); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	msg, err := tr.RecvHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "ready" {
+		t.Fatalf("got handshake %q, want %q", msg, "ready")
+	}
+}
+
+func TestZmtpRejected(t *testing.T) {
+	var logged bytes.Buffer
+	tr, err := newZmtpTransport(Config{Endpoint: "tcp://127.0.0.1:0", Role: RoleBind, Logger: log.New(&logged, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	addr := tr.(*zmtpTransport).ln.Addr().String()
+
+	go func() {
+		for _, socketType := range []string{"PUB", "REQ"} {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c, err := newZmtpConn(conn, socketType, "REP")
+			if err != nil {
+				continue
+			}
+			defer c.Close()
+			if err = c.writeMessage([]byte{}, []byte("ready")); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	msg, err := tr.RecvHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "ready" {
+		t.Fatalf("got handshake %q, want %q", msg, "ready")
+	}
+	if !strings.HasPrefix(logged.String(), "Rejected broker connection") {
+		t.Errorf("got log %q, want the rejected connection", logged.String())
+	}
+}
+
+func TestZmtpRecvTimeout(t *testing.T) {
+	tr, err := newZmtpTransport(Config{Endpoint: "tcp://127.0.0.1:0", Role: RoleBind, RecvTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if _, err = tr.RecvHandshake(); err == nil {
+		t.Fatal("expected a timeout")
+	}
+}
+
+// silentClient connects to addr and never says anything.
+func silentClient(t *testing.T, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+}
+
+func TestZmtpCloseGreeting(t *testing.T) {
+	tr, addr := listenZmtp(t)
+	silentClient(t, addr)
+
+	done := make(chan error)
+	go func() {
+		_, err := tr.RecvHandshake()
+		done <- err
+	}()
+	// Wait for the greeting to start.
+	for {
+		tr.mu.Lock()
+		greeting := tr.greeting
+		tr.mu.Unlock()
+		if greeting != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	tr.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("got a handshake from a closed transport")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not interrupt the greeting")
+	}
+}
+
+func TestZmtpGreetingTimeout(t *testing.T) {
+	tr, err := newZmtpTransport(Config{Endpoint: "tcp://127.0.0.1:0", Role: RoleBind, RecvTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	silentClient(t, tr.(*zmtpTransport).ln.Addr().String())
+
+	start := time.Now()
+	if _, err = tr.RecvHandshake(); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("timed out after %v, want about 100ms", d)
+	}
+}
+
+func TestZmtpIpc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batsky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "batsky.sock")
+	tr, err := newZmtpTransport(Config{Endpoint: "ipc://" + path, Role: RoleBind})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	go func() {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req, err := newZmtpConn(conn, "REQ", "REP")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer req.Close()
+		if err = req.writeMessage([]byte{}, []byte("ready")); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	msg, err := tr.RecvHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "ready" {
+		t.Fatalf("got handshake %q, want %q", msg, "ready")
+	}
+}
@@ -0,0 +1,310 @@
+// Package wait provides the loop and polling helpers of
+// k8s.io/apimachinery/pkg/util/wait, with the same signatures, on the time
+// of the simulation as told by github.com/oar-team/batsky-go/time.
+//
+// The jitter is drawn from a source of its own, seeded with Seed, so that
+// jittered loops run at the same simulated instants from one run to the
+// next.
+package wait
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	btime "github.com/oar-team/batsky-go/time"
+)
+
+// ErrWaitTimeout is returned when the condition exited without success.
+var ErrWaitTimeout = errors.New("timed out waiting for the condition")
+
+// NeverStop may be passed to Until to make it never stop.
+var NeverStop <-chan struct{} = make(chan struct{})
+
+// ConditionFunc returns true if the condition is satisfied, or an error
+// if the loop should be aborted.
+type ConditionFunc func() (done bool, err error)
+
+// defaultSeed is the seed of the jitter until Seed is called.
+const defaultSeed = 1
+
+// jitter is the source of the jitter of every loop.
+var jitter = struct {
+	sync.Mutex
+	rand *rand.Rand
+}{rand: rand.New(rand.NewSource(defaultSeed))}
+
+// Seed restarts the jitter from the given seed. The sequence of jittered
+// durations after it only depends on seed and on the calls made since.
+func Seed(seed int64) {
+	jitter.Lock()
+	defer jitter.Unlock()
+	jitter.rand.Seed(seed)
+}
+
+// Jitter returns a time.Duration between duration and duration +
+// maxFactor * duration.
+//
+// This allows clients to avoid converging on periodic behavior. If
+// maxFactor is 0.0, a suggested default value will be chosen.
+func Jitter(duration time.Duration, maxFactor float64) time.Duration {
+	if maxFactor <= 0.0 {
+		maxFactor = 1.0
+	}
+	jitter.Lock()
+	f := jitter.rand.Float64()
+	jitter.Unlock()
+	return duration + time.Duration(f*maxFactor*float64(duration))
+}
+
+// Forever calls f every period for ever.
+//
+// Forever is syntactic sugar on top of Until.
+func Forever(f func(), period time.Duration) {
+	Until(f, period, NeverStop)
+}
+
+// Until loops until stop channel is closed, running f every period.
+//
+// Until is syntactic sugar on top of JitterUntil with zero jitter factor
+// and with sliding = true (which means the timer for period starts after
+// the f completes).
+func Until(f func(), period time.Duration, stopCh <-chan struct{}) {
+	JitterUntil(f, period, 0.0, true, stopCh)
+}
+
+// NonSlidingUntil loops until stop channel is closed, running f every
+// period.
+//
+// NonSlidingUntil is syntactic sugar on top of JitterUntil with zero
+// jitter factor, with sliding = false (meaning the timer for period starts
+// at the same time as the function starts).
+func NonSlidingUntil(f func(), period time.Duration, stopCh <-chan struct{}) {
+	JitterUntil(f, period, 0.0, false, stopCh)
+}
+
+// JitterUntil loops until stop channel is closed, running f every period.
+//
+// If jitterFactor is positive, the period is jittered before every run of
+// f. If jitterFactor is not positive, the period is unchanged and not
+// jittered.
+//
+// If sliding is true, the period is computed after f runs. If it is false
+// then period includes the runtime for f.
+//
+// Close stopCh to stop. f may not be invoked if stop channel is already
+// closed. Pass NeverStop if you don't want it to stop.
+func JitterUntil(f func(), period time.Duration, jitterFactor float64, sliding bool, stopCh <-chan struct{}) {
+	var t *btime.Timer
+	var sawTimeout bool
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+
+		jitteredPeriod := period
+		if jitterFactor > 0.0 {
+			jitteredPeriod = Jitter(period, jitterFactor)
+		}
+
+		if !sliding {
+			t = resetOrReuseTimer(t, jitteredPeriod, sawTimeout)
+		}
+
+		f()
+
+		if sliding {
+			t = resetOrReuseTimer(t, jitteredPeriod, sawTimeout)
+		}
+
+		select {
+		case <-stopCh:
+			t.Stop()
+			return
+		case <-t.C:
+			sawTimeout = true
+		}
+	}
+}
+
+// resetOrReuseTimer avoids allocating a new timer if one is already in
+// use. sawTimeout tells whether the channel of t was already drained.
+func resetOrReuseTimer(t *btime.Timer, d time.Duration, sawTimeout bool) *btime.Timer {
+	if t == nil {
+		return btime.NewTimer(d)
+	}
+	if !t.Stop() && !sawTimeout {
+		<-t.C
+	}
+	t.Reset(d)
+	return t
+}
+
+// Poll tries a condition func until it returns true, an error, or the
+// timeout is reached.
+//
+// Poll always waits the interval before the run of 'condition'.
+// 'condition' will always be invoked at least once.
+//
+// If you want to Poll something forever, see PollInfinite.
+func Poll(interval, timeout time.Duration, condition ConditionFunc) error {
+	return poll(false, interval, timeout, condition)
+}
+
+// PollImmediate tries a condition func until it returns true, an error,
+// or the timeout is reached.
+//
+// PollImmediate always checks 'condition' before waiting for the interval.
+// 'condition' will always be invoked at least once.
+//
+// If you want to immediately Poll something forever, see
+// PollImmediateInfinite.
+func PollImmediate(interval, timeout time.Duration, condition ConditionFunc) error {
+	return poll(true, interval, timeout, condition)
+}
+
+// PollInfinite tries a condition func until it returns true or an error.
+//
+// PollInfinite always waits the interval before the run of 'condition'.
+func PollInfinite(interval time.Duration, condition ConditionFunc) error {
+	return poll(false, interval, 0, condition)
+}
+
+// PollImmediateInfinite tries a condition func until it returns true or
+// an error.
+//
+// PollImmediateInfinite runs the 'condition' before waiting for the
+// interval.
+func PollImmediateInfinite(interval time.Duration, condition ConditionFunc) error {
+	return poll(true, interval, 0, condition)
+}
+
+// poll runs condition every interval, first at once if immediate, until
+// it is done, fails, or timeout is over. A zero timeout never ends. The
+// condition is checked one last time when the timeout ends.
+func poll(immediate bool, interval, timeout time.Duration, condition ConditionFunc) error {
+	if immediate {
+		if ok, err := condition(); err != nil || ok {
+			return err
+		}
+	}
+	tick := btime.NewTicker(interval)
+	defer tick.Stop()
+
+	var after <-chan time.Time
+	if timeout != 0 {
+		timer := btime.NewTimer(timeout)
+		defer timer.Stop()
+		after = timer.C
+	}
+	for {
+		select {
+		case <-tick.C:
+			// The timeout may be due at the same instant.
+			select {
+			case <-after:
+				return lastCheck(condition)
+			default:
+			}
+			if ok, err := condition(); err != nil || ok {
+				return err
+			}
+		case <-after:
+			return lastCheck(condition)
+		}
+	}
+}
+
+// lastCheck runs condition once the timeout of a poll is over.
+func lastCheck(condition ConditionFunc) error {
+	ok, err := condition()
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	return ErrWaitTimeout
+}
+
+// Backoff holds parameters applied to a Backoff function.
+type Backoff struct {
+	// The initial duration.
+	Duration time.Duration
+	// Duration is multiplied by factor each iteration, if factor is not
+	// zero and the limits imposed by Steps and Cap have not been reached.
+	// Should not be negative.
+	// The jitter does not contribute to the updates to the duration
+	// parameter.
+	Factor float64
+	// The sleep at each iteration is the duration plus an additional
+	// amount chosen uniformly at random from the interval between zero
+	// and `jitter*duration`.
+	Jitter float64
+	// The remaining number of iterations in which the duration parameter
+	// may change (but progress can be stopped earlier by hitting the cap).
+	// If not positive, the duration is not changed. Used for exponential
+	// backoff in combination with Factor and Cap.
+	Steps int
+	// A limit on revised values of the duration parameter. If a
+	// multiplication by the factor parameter would make the duration
+	// exceed the cap then the duration is set to the cap and the steps
+	// parameter is set to zero.
+	Cap time.Duration
+}
+
+// Step (1) returns an amount of time to sleep determined by the original
+// Duration and Jitter and (2) mutates the provided Backoff to update its
+// Steps and Duration.
+func (b *Backoff) Step() time.Duration {
+	if b.Steps < 1 {
+		if b.Jitter > 0 {
+			return Jitter(b.Duration, b.Jitter)
+		}
+		return b.Duration
+	}
+	b.Steps--
+
+	duration := b.Duration
+
+	// calculate the next step
+	if b.Factor != 0 {
+		b.Duration = time.Duration(float64(b.Duration) * b.Factor)
+		if b.Cap > 0 && b.Duration > b.Cap {
+			b.Duration = b.Cap
+			b.Steps = 0
+		}
+	}
+
+	if b.Jitter > 0 {
+		duration = Jitter(duration, b.Jitter)
+	}
+	return duration
+}
+
+// ExponentialBackoff repeats a condition check with exponential backoff.
+//
+// It repeatedly checks the condition and then sleeps, using
+// `backoff.Step()` to determine the length of the sleep and adjust
+// Duration and Steps. Stops and returns as soon as:
+// 1. the condition check returns true or an error,
+// 2. `backoff.Steps` checks of the condition have been done, or
+// 3. a sleep truncated by the cap on duration has been completed.
+// In case (1) the returned error is what the condition function returned.
+// In all other cases, ErrWaitTimeout is returned.
+func ExponentialBackoff(backoff Backoff, condition ConditionFunc) error {
+	for backoff.Steps > 0 {
+		if ok, err := condition(); err != nil || ok {
+			return err
+		}
+		if backoff.Steps == 1 {
+			break
+		}
+		btime.Sleep(backoff.Step())
+	}
+	return ErrWaitTimeout
+}
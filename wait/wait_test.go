@@ -0,0 +1,154 @@
+package wait
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	btime "github.com/oar-team/batsky-go/time"
+)
+
+func TestMain(m *testing.M) {
+	c := btime.DefaultConfig()
+	c.Mode, c.AutoAdvance = btime.ModeVirtual, true
+	if err := btime.Configure(c); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// runs returns the simulated instants of n runs of f by the loop started
+// by until, relative to the start.
+func runs(n int, until func(f func(), stopCh <-chan struct{})) []time.Duration {
+	start := btime.Now()
+	stop := make(chan struct{})
+	var got []time.Duration
+	until(func() {
+		got = append(got, btime.Now().Sub(start))
+		if len(got) == n {
+			close(stop)
+		}
+	}, stop)
+	return got
+}
+
+func TestUntil(t *testing.T) {
+	got := runs(3, func(f func(), stop <-chan struct{}) {
+		Until(func() {
+			f()
+			btime.Sleep(time.Second)
+		}, time.Minute, stop)
+	})
+	want := []time.Duration{0, 61 * time.Second, 122 * time.Second}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Until ran at %v, want %v", got, want)
+	}
+
+	got = runs(3, func(f func(), stop <-chan struct{}) {
+		NonSlidingUntil(func() {
+			f()
+			btime.Sleep(time.Second)
+		}, time.Minute, stop)
+	})
+	want = []time.Duration{0, time.Minute, 2 * time.Minute}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NonSlidingUntil ran at %v, want %v", got, want)
+	}
+}
+
+func TestUntilStopped(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+	Until(func() { t.Error("f called after stop") }, time.Second, stop)
+}
+
+func TestJitterUntil(t *testing.T) {
+	jittered := func() []time.Duration {
+		return runs(5, func(f func(), stop <-chan struct{}) {
+			JitterUntil(f, time.Minute, 0.5, true, stop)
+		})
+	}
+	Seed(42)
+	first := jittered()
+	for i := 1; i < len(first); i++ {
+		if d := first[i] - first[i-1]; d < time.Minute || d > 90*time.Second {
+			t.Errorf("period %d is %v, want between 1m and 1m30s", i, d)
+		}
+	}
+	Seed(42)
+	if second := jittered(); !reflect.DeepEqual(first, second) {
+		t.Errorf("runs at %v with the same seed, then at %v", first, second)
+	}
+}
+
+func TestPollImmediate(t *testing.T) {
+	start := btime.Now()
+	calls := 0
+	err := PollImmediate(time.Second, time.Minute, func() (bool, error) {
+		calls++
+		return calls == 3, nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("got %v after %d calls, want nil after 3", err, calls)
+	}
+	if d := btime.Now().Sub(start); d != 2*time.Second {
+		t.Errorf("polled for %v, want %v", d, 2*time.Second)
+	}
+
+	start = btime.Now()
+	calls = 0
+	err = PollImmediate(time.Second, 10*time.Second, func() (bool, error) {
+		calls++
+		return false, nil
+	})
+	if err != ErrWaitTimeout {
+		t.Errorf("got %v, want %v", err, ErrWaitTimeout)
+	}
+	if d := btime.Now().Sub(start); d != 10*time.Second {
+		t.Errorf("timed out after %v, want %v", d, 10*time.Second)
+	}
+	if calls != 11 {
+		t.Errorf("condition called %d times, want 11", calls)
+	}
+
+	errFailed := errors.New("failed")
+	err = PollImmediate(time.Second, time.Minute, func() (bool, error) {
+		return false, errFailed
+	})
+	if err != errFailed {
+		t.Errorf("got %v, want %v", err, errFailed)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	start := btime.Now()
+	var got []time.Duration
+	backoff := Backoff{Duration: time.Second, Factor: 2, Steps: 5, Cap: 5 * time.Second}
+	err := ExponentialBackoff(backoff, func() (bool, error) {
+		got = append(got, btime.Now().Sub(start))
+		return false, nil
+	})
+	if err != ErrWaitTimeout {
+		t.Errorf("got %v, want %v", err, ErrWaitTimeout)
+	}
+	// 1s, 2s, then 4s after which the duration is capped, which ends
+	// the steps.
+	want := []time.Duration{0, time.Second, 3 * time.Second}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("checked at %v, want %v", got, want)
+	}
+	if d := btime.Now().Sub(start); d != 7*time.Second {
+		t.Errorf("backed off for %v, want %v", d, 7*time.Second)
+	}
+
+	calls := 0
+	err = ExponentialBackoff(Backoff{Duration: time.Second, Steps: 5}, func() (bool, error) {
+		calls++
+		return calls == 2, nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("got %v after %d calls, want nil after 2", err, calls)
+	}
+}